@@ -0,0 +1,209 @@
+// Copyright 2023 Luis Ángel Méndez Gort
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+module internal Migrate.Calculation.Dependencies
+
+open System
+open System.Text.RegularExpressions
+open Migrate.Types
+open Migrate.Checks.Algorithms
+
+let sqlTokens (sql: string) =
+  Regex.Matches(sql, @"'(?:[^']|'')*'|""[^""]*""|\w+|\S") |> Seq.map _.Value |> Seq.toList
+
+let isKeyword (k: string) (t: string) =
+  String.Equals(k, t, StringComparison.OrdinalIgnoreCase)
+
+let clauseKeywords =
+  [ "WHERE"; "GROUP"; "ORDER"; "LIMIT"; "HAVING"; "WINDOW"; "UNION"; "EXCEPT"; "INTERSECT"
+    "JOIN"; "LEFT"; "RIGHT"; "FULL"; "INNER"; "OUTER"; "CROSS"; "NATURAL"; "ON"; "USING" ]
+
+let isIdent (t: string) =
+  t.StartsWith "\"" || Char.IsLetter t[0] || t[0] = '_'
+
+let isAlias (t: string) =
+  isIdent t && not (clauseKeywords |> List.exists (fun k -> isKeyword k t))
+
+/// <summary>
+/// Names bound by the common table expressions of a WITH clause, i.e. those followed by AS and
+/// a parenthesized query, with or without a list of columns in between
+/// </summary>
+let commonTableNames (tokens: string list) =
+  let rec bound =
+    function
+    | name :: a :: "(" :: rest when isIdent name && isKeyword "AS" a -> name.Trim '"' :: bound rest
+    | name :: "(" :: rest when isIdent name ->
+      match rest |> List.skipWhile ((<>) ")") with
+      | ")" :: a :: "(" :: _ when isKeyword "AS" a -> name.Trim '"' :: bound rest
+      | _ -> bound rest
+    | _ :: rest -> bound rest
+    | [] -> []
+
+  bound tokens |> Set.ofList
+
+/// <summary>
+/// Names of the relations a SELECT statement reads from, i.e. those after FROM, JOIN
+/// and the commas separating a FROM list, excluding common table expressions
+/// </summary>
+let selectedRelations (sql: string) =
+  let relationName =
+    function
+    | _ :: "." :: name :: rest when isIdent name -> name.Trim '"', rest
+    | name :: rest -> name.Trim '"', rest
+    | [] -> "", []
+
+  let rec afterRelation =
+    function
+    | a :: alias :: rest when isKeyword "AS" a && isIdent alias -> afterRelation rest
+    | "," :: r :: rest when isIdent r -> fromRelation (r :: rest)
+    | alias :: rest when isAlias alias -> afterRelation rest
+    | rest -> scan rest
+
+  and fromRelation xs =
+    let name, rest = relationName xs
+    name :: afterRelation rest
+
+  and scan =
+    function
+    | k :: _ :: "(" :: rest when isKeyword "FROM" k || isKeyword "JOIN" k -> scan rest
+    | k :: r :: rest when (isKeyword "FROM" k || isKeyword "JOIN" k) && isIdent r -> fromRelation (r :: rest)
+    | _ :: rest -> scan rest
+    | [] -> []
+
+  let tokens = sqlTokens sql
+  let commonTables = commonTableNames tokens
+  tokens |> scan |> List.filter (commonTables.Contains >> not) |> List.distinct
+
+let tableReferences (table: CreateTable) =
+  table.constraints @ (table.columns |> List.collect _.constraints)
+  |> List.choose (function
+    | ForeignKey fk -> Some fk.refTable
+    | _ -> None)
+  |> List.distinct
+
+/// <summary>
+/// Relations used by a trigger: its table, those its body selects from, and those it inserts into
+/// or updates
+/// </summary>
+let triggerRelations (trigger: CreateTrigger) =
+  let rec written =
+    function
+    | k :: r :: rest when isKeyword "INTO" k && isIdent r -> r.Trim '"' :: written rest
+    | k :: o :: _ :: r :: rest when isKeyword "UPDATE" k && isKeyword "OR" o && isIdent r -> r.Trim '"' :: written rest
+    | k :: r :: rest when isKeyword "UPDATE" k && isIdent r && not (isKeyword "OF" r || isKeyword "ON" r) ->
+      r.Trim '"' :: written rest
+    | _ :: rest -> written rest
+    | [] -> []
+
+  trigger.table :: written (sqlTokens trigger.sql) @ selectedRelations trigger.sql
+  |> List.distinct
+
+// relations SQLite provides, like sqlite_schema or the pragma_table_info table-valued function
+let isBuiltinRelation (name: string) =
+  name.StartsWith("sqlite_", StringComparison.OrdinalIgnoreCase)
+  || name.StartsWith("pragma_", StringComparison.OrdinalIgnoreCase)
+
+/// <summary>
+/// Maps every table, view and trigger in the file to the relations it depends on: the tables
+/// referenced by foreign keys for tables, the relations selected for views, and the relations
+/// used by triggers. Virtual tables depend on none, and relations SQLite provides are left out,
+/// as well as views and triggers using themselves
+/// </summary>
+let dependentRelations (file: SqlFile) =
+  let declared name = List.filter (fun r -> r <> name && not (isBuiltinRelation r))
+  let tables = file.tables |> List.map (fun t -> t.name, tableReferences t)
+  let virtualTables = file.virtualTables |> List.map (fun t -> t.name, [])
+  let views = file.views |> List.map (fun v -> v.name, selectedRelations v.selectUnion |> declared v.name)
+  let triggers = file.triggers |> List.map (fun t -> t.name, triggerRelations t |> declared t.name)
+
+  // triggers can be named like their table, since SQLite keeps their names apart from the relations'
+  tables @ virtualTables @ views @ triggers
+  |> List.groupBy fst
+  |> List.map (fun (name, xs) -> name, xs |> List.collect snd |> List.distinct)
+  |> Map.ofList
+
+/// <summary>
+/// Raises MissingDependencies with the relations depending on others that aren't defined
+/// in the file, and the names of those missing relations
+/// </summary>
+let checkDependencies (file: SqlFile) =
+  let graph = dependentRelations file
+
+  let missing =
+    graph
+    |> Map.map (fun _ deps -> deps |> List.filter (graph.ContainsKey >> not))
+    |> Map.filter (fun _ deps -> not deps.IsEmpty)
+
+  if not missing.IsEmpty then
+    let relations = missing.Keys |> Seq.toList
+    let dependencies = missing.Values |> List.concat |> List.distinct
+    MissingDependencies(relations, dependencies) |> raise
+
+/// <summary>
+/// Relations sorted so each one comes after the ones it depends on. Relations without dependencies
+/// that no other relation depends on are appended at the end in alphabetical order. Tables referencing
+/// each other are sorted ignoring the references between them
+/// </summary>
+let sortedRelations (file: SqlFile) =
+  let dependencies = dependentRelations file
+  let tables = file.tables |> List.map _.name
+  let isTable = (Set.ofList tables).Contains
+
+  let referencedTables t =
+    dependencies |> Map.tryFind t |> Option.defaultValue [] |> List.filter isTable
+
+  let cycleOf =
+    stronglyConnected referencedTables tables
+    |> List.mapi (fun i ts -> ts |> List.map (fun t -> t, i))
+    |> List.concat
+    |> Map.ofList
+
+  // SQLite checks foreign keys when rows change, not when tables are created, so the references
+  // between tables in a cycle are left out of the order
+  let graph =
+    dependencies
+    |> Map.map (fun r deps ->
+      if isTable r then
+        deps |> List.filter (fun d -> not (isTable d && cycleOf[d] = cycleOf[r]))
+      else
+        deps)
+
+  let referenced = graph.Values |> Seq.concat |> Set.ofSeq
+
+  let isolated, dependent =
+    graph.Keys
+    |> Seq.toList
+    |> List.partition (fun r -> graph[r].IsEmpty && not (referenced.Contains r))
+
+  match topologicalSortChecked (fun r -> graph[r]) dependent with
+  | Ok relations -> relations @ isolated
+  | Error cycle -> DependencyCycle cycle |> raise
+
+/// <summary>
+/// Sorts tables, views and triggers so every one comes after the relations it depends on, and indexes
+/// in the order of the tables they belong to
+/// </summary>
+let sortFile (file: SqlFile) =
+  let position =
+    sortedRelations file |> List.mapi (fun i r -> r, i) |> Map.ofList
+
+  let byPosition name =
+    position |> Map.tryFind name |> Option.defaultValue -1
+
+  { file with
+      tables = file.tables |> List.sortBy (fun t -> byPosition t.name)
+      virtualTables = file.virtualTables |> List.sortBy (fun t -> byPosition t.name)
+      views = file.views |> List.sortBy (fun v -> byPosition v.name)
+      indexes = file.indexes |> List.sortBy (fun i -> byPosition i.table)
+      triggers = file.triggers |> List.sortBy (fun t -> byPosition t.name) }
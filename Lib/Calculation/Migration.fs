@@ -14,23 +14,58 @@
 
 module internal Migrate.Calculation.Migration
 
+open System.Text.Json
+open Migrate
 open Migrate.Types
 open TableSync
 
 let tablesMigration (dbSchema: SqlFile) (p: Project) =
   Solver.createTable dbSchema.tables p.source.tables
 
+let virtualTablesMigration (dbSchema: SqlFile) (p: Project) =
+  Solver.createVirtualTable dbSchema.virtualTables p.source.virtualTables
+
 let viewsMigration (dbSchema: SqlFile) (p: Project) =
   Solver.createView dbSchema.views p.source.views
 
-let columnsMigration (dbSchema: SqlFile) (p: Project) =
+let indexesMigration (dbSchema: SqlFile) (p: Project) =
+  Solver.createIndex dbSchema.indexes p.source.indexes
+
+let triggersMigration (dbSchema: SqlFile) (p: Project) =
+  Solver.createTrigger dbSchema.triggers p.source.triggers
+
+/// <summary>
+/// Column changes of the tables in both schemas. Renamed columns are migrated with
+/// ALTER TABLE ... RENAME COLUMN, or by rebuilding their table when rebuildRenames is set.
+/// copyColumns maps table names to the expressions filling their columns when they are rebuilt
+/// </summary>
+let columnsMigrationWith
+  (rebuildRenames: bool)
+  (copyColumns: Map<string, Map<string, string>>)
+  (dbSchema: SqlFile)
+  (p: Project)
+  =
   let homologousColumns =
     zipHomologous dbSchema.tables p.source.tables (fun c -> c.name) (fun c -> c.columns)
 
   homologousColumns
-  |> List.map (fun (table, left, right) -> Solver.columns dbSchema.views (findTable p.source table) left right)
+  |> List.map (fun (table, left, right) ->
+    let copy = copyColumns.TryFind table |> Option.defaultValue Map.empty
+    Solver.columns rebuildRenames copy dbSchema.views (findTable p.source table) left right)
   |> List.concat
 
+let columnsMigration = columnsMigrationWith false Map.empty
+
+// SQLite rewrites the views referencing a renamed column, renaming it before views are migrated
+// avoids recreating them with a column that doesn't exist yet, which makes the rename fail.
+// Columns renamed by rebuilding their table are left to the columns migration
+let columnRenamesMigration (rebuildRenames: bool) (dbSchema: SqlFile) (p: Project) =
+  if rebuildRenames then
+    []
+  else
+    columnsMigration dbSchema p
+    |> List.filter (fun s -> s.statements |> List.forall SqlGeneration.Column.isRenameColumn)
+
 let constraintsMigration (dbSchema: SqlFile) (p: Project) =
   let homologousConstraints =
     zipHomologous dbSchema.tables p.source.tables (fun c -> c.name) (fun c -> c.constraints)
@@ -39,12 +74,184 @@ let constraintsMigration (dbSchema: SqlFile) (p: Project) =
   |> List.map (fun (table, left, right) -> Solver.constraints dbSchema.views (findTable p.source table) left right)
   |> List.concat
 
-let migration (dbSchema: SqlFile) (p: Project) =
+let tableOptionsMigration (dbSchema: SqlFile) (p: Project) =
+  let homologousTables = zipHomologous dbSchema.tables p.source.tables (fun c -> c.name) id
+
+  homologousTables
+  |> List.map (fun (_, left, right) -> Solver.tableOptions dbSchema.views left right)
+  |> List.concat
+
+let diffBy (key: 'a -> string) (definition: 'a -> string) (xs: 'a list) (ys: 'a list) =
+  let removes, adds = Solver.difference xs ys key
+
+  let changes =
+    Solver.listToSet xs ys key
+    |> Solver.intersect
+    |> List.filter (fun (x, y) -> definition x <> definition y)
+    |> List.map (fun (x, y) -> Changed(definition x, definition y))
+
+  (removes |> List.map (key >> Removed)) @ (adds |> List.map (key >> Added)) @ changes
+
+// pairs every x with the first y left that same matches it, returning the pairs,
+// the xs without a match and the ys without one
+let private matchBy (same: 'a -> 'a -> bool) (xs: 'a list) (ys: 'a list) =
+  let pairs, removes, adds =
+    xs
+    |> List.fold
+      (fun (pairs, removes, ys) x ->
+        match ys |> List.tryFindIndex (same x) with
+        | Some i -> (x, ys[i]) :: pairs, removes, List.removeAt i ys
+        | None -> pairs, x :: removes, ys)
+      ([], [], ys)
+
+  List.rev pairs, List.rev removes, adds
+
+// like diffBy, for the items same matches instead of the ones with the same key
+let private diffWith (same: 'a -> 'a -> bool) (key: 'a -> string) (definition: 'a -> string) (xs: 'a list) (ys: 'a list) =
+  let pairs, removes, adds = matchBy same xs ys
+
+  let changes =
+    pairs
+    |> List.filter (fun (x, y) -> definition x <> definition y)
+    |> List.map (fun (x, y) -> Changed(definition x, definition y))
+
+  (removes |> List.map (key >> Removed)) @ (adds |> List.map (key >> Added)) @ changes
+
+/// <summary>
+/// Matches tables and columns by name
+/// </summary>
+let defaultDiffer =
+  { sameTable = fun x y -> x.name = y.name
+    sameColumn = fun x y -> x.name = y.name }
+
+/// <summary>
+/// Every difference between two schemas at once: relations and indexes added and removed,
+/// and changed ones with their old and new definitions. Tables and their columns are matched
+/// with differ, views and indexes by name. Columns are named as table.column, with the table's
+/// name in the desired schema, also in the definitions of changed ones
+/// </summary>
+let compareSchemasWith (differ: Differ) (left: SqlFile) (right: SqlFile) =
+  let sqlTable = SqlGeneration.Table.sqlCreateTable >> String.concat ""
+  let sqlVirtualTable = SqlGeneration.Table.sqlCreateVirtualTable >> String.concat ""
+  let sqlView = SqlGeneration.View.sqlCreateView >> String.concat ""
+  let sqlIndex = SqlGeneration.Index.sqlCreateIndex >> String.concat ""
+
+  let tablePairs, _, _ = matchBy differ.sameTable left.tables right.tables
+
+  let columns =
+    tablePairs
+    |> List.collect (fun (l, r) ->
+      let definition (c: ColumnDef) =
+        $"{r.name}.{SqlGeneration.Table.sqlColumnDef c}"
+
+      diffWith differ.sameColumn (fun (c: ColumnDef) -> $"{r.name}.{c.name}") definition l.columns r.columns)
+
+  { tables =
+      diffWith differ.sameTable (fun (t: CreateTable) -> t.name) sqlTable left.tables right.tables
+      @ diffBy (fun (t: CreateVirtualTable) -> t.name) sqlVirtualTable left.virtualTables right.virtualTables
+    columns = columns
+    views = diffBy (fun (v: CreateView) -> v.name) sqlView left.views right.views
+    indexes = diffBy (fun (i: CreateIndex) -> i.name) sqlIndex left.indexes right.indexes }
+
+/// <summary>
+/// Like compareSchemasWith, matching tables and columns by name
+/// </summary>
+let compareSchemas = compareSchemasWith defaultDiffer
+
+/// <summary>
+/// Pairs the statements of a step with its reason, flagged when the Solver found the step can
+/// lose data, like dropping a table or rebuilding one with a constraint its rows can break
+/// </summary>
+let annotateStatements (reason: Diff) (destructive: bool) (statements: string list) =
+  statements
+  |> List.map (fun sql ->
+    { sql = sql
+      destructive = destructive
+      reason = reason })
+
+/// <summary>
+/// JSON array with an object for every statement, holding its SQL, the operation (added, removed
+/// or changed), the object it targets and whether it can lose data
+/// </summary>
+let planJson (statements: AnnotatedStatement list) =
+  statements
+  |> List.map (fun s ->
+    let operation, target =
+      match s.reason with
+      | Added x -> "added", x
+      | Removed x -> "removed", x
+      | Changed(_, x) -> "changed", x
+
+    {| sql = s.sql
+       operation = operation
+       target = target
+       destructive = s.destructive |})
+  |> JsonSerializer.Serialize
+
+/// <summary>
+/// Splits a schema into its persistent relations and its temporary ones, with the indexes and
+/// inserts of temporary tables among the latter
+/// </summary>
+let splitTemporary (f: SqlFile) =
+  let temporaryTables = f.tables |> List.filter _.temporary |> List.map _.name |> Set.ofList
+
+  let persistent =
+    { f with
+        tables = f.tables |> List.filter (_.temporary >> not)
+        views = f.views |> List.filter (_.temporary >> not)
+        triggers = f.triggers |> List.filter (_.temporary >> not)
+        indexes = f.indexes |> List.filter (fun i -> not (temporaryTables.Contains i.table))
+        inserts = f.inserts |> List.filter (fun i -> not (temporaryTables.Contains i.table)) }
+
+  let temporary =
+    { tables = f.tables |> List.filter _.temporary
+      views = f.views |> List.filter _.temporary
+      triggers = f.triggers |> List.filter _.temporary
+      indexes = f.indexes |> List.filter (fun i -> temporaryTables.Contains i.table)
+      inserts = f.inserts |> List.filter (fun i -> temporaryTables.Contains i.table)
+      virtualTables = [] }
+
+  persistent, temporary
+
+/// <summary>
+/// Steps creating the temporary relations in the project's schema, left out of the migration
+/// since the database doesn't keep them
+/// </summary>
+let temporaryMigration (source: SqlFile) =
+  let temporary = source |> Dependencies.sortFile |> splitTemporary |> snd
+
+  Solver.createTable [] temporary.tables
+  @ Solver.createView [] temporary.views
+  @ Solver.createIndex [] temporary.indexes
+  @ Solver.createTrigger [] temporary.triggers
+
+/// <summary>
+/// First non empty set of steps taking the database schema closer to the project's one.
+/// Temporary relations aren't part of it
+/// </summary>
+let migrationWith
+  (rebuildRenames: bool)
+  (copyColumns: Map<string, Map<string, string>>)
+  (dbSchema: SqlFile)
+  (p: Project)
+  =
+  Dependencies.checkDependencies p.source
+  let dbSchema = Dependencies.sortFile dbSchema
+
+  let p =
+    { p with
+        source = p.source |> splitTemporary |> fst |> Dependencies.sortFile }
+
   let migrators =
     [ tablesMigration
+      virtualTablesMigration
+      columnRenamesMigration rebuildRenames
       viewsMigration
-      columnsMigration
+      columnsMigrationWith rebuildRenames copyColumns
       constraintsMigration
+      tableOptionsMigration
+      indexesMigration
+      triggersMigration
       insertsMigration ]
 
   let findMap (f: 'a -> 'b option) (xs: 'a list) = xs |> Seq.choose f |> Seq.tryHead
@@ -56,3 +263,5 @@ let migration (dbSchema: SqlFile) (p: Project) =
 
   let foundMigration migrator = migrator dbSchema p |> nonEmpty
   migrators |> findMap foundMigration
+
+let migration = migrationWith false Map.empty
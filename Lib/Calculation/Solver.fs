@@ -36,11 +36,12 @@ let listToSet (xs: 'a list) (ys: 'a list) (keySel: 'a -> string) =
     right = right
     setRight = setRight }
 
-let difference (r: 'a SetResult) =
-  let left, setLeft, right, setRight = r.left, r.setLeft, r.right, r.setRight
-
-  let removes = setLeft - setRight |> Set.toList |> List.map (fun d -> left[d])
-  let adds = setRight - setLeft |> Set.toList |> List.map (fun d -> right[d])
+let difference (xs: 'a list) (ys: 'a list) (keySel: 'a -> string) =
+  let keys zs = zs |> List.map keySel |> Set.ofList
+  let setLeft, setRight = keys xs, keys ys
+  let notIn (set: Set<string>) = List.filter (keySel >> set.Contains >> not)
+  let removes = xs |> List.distinctBy keySel |> notIn setRight
+  let adds = ys |> List.distinctBy keySel |> notIn setLeft
   (removes, adds)
 
 let intersect (r: 'a SetResult) =
@@ -58,85 +59,374 @@ let createDelete
   (sqlDelete: 'a -> string list)
   (sqlCreate: 'a -> string list)
   =
-  let sets = listToSet xs ys keySel
-  let removes, adds = difference sets
+  let removes, adds = difference xs ys keySel
 
   let drops: list<SolverProposal> =
     removes
     |> List.map (fun r ->
       { reason = Removed(nameSel r)
-        statements = sqlDelete r })
+        statements = sqlDelete r
+        rebuilds = None
+        warning = None
+        destructive = false })
 
   let creates: list<SolverProposal> =
     adds
     |> List.map (fun r ->
       { reason = Added(nameSel r)
-        statements = sqlCreate r })
+        statements = sqlCreate r
+        rebuilds = None
+        warning = None
+        destructive = false })
 
   drops @ creates
 
-let createDeleteUpdate
+/// <summary>
+/// Like createDelete, for lists sorted so every item comes after the ones it depends on:
+/// dependents are dropped before their dependencies and created after them
+/// </summary>
+let createDeleteSorted
   (xs: 'a list)
   (ys: 'a list)
-  (toString: 'a -> string)
+  (nameSel: 'a -> string)
   (keySel: 'a -> string)
   (sqlDelete: 'a -> string list)
   (sqlCreate: 'a -> string list)
-  (sqlUpdate: 'a -> 'a -> string list option)
   =
-  let sets = listToSet xs ys keySel
-  let removes, adds = difference sets
-  let common = intersect sets
+  createDelete (List.rev xs) ys nameSel keySel sqlDelete sqlCreate
+
+let createDeleteRename
+  (xs: 'a list)
+  (ys: 'a list)
+  (nameSel: 'a -> string)
+  (sameStructure: 'a -> 'a -> bool)
+  (sqlDelete: 'a -> string list)
+  (sqlCreate: 'a -> string list)
+  (sqlRename: 'a -> 'a -> string list)
+  =
+  let removes, adds = difference xs ys nameSel
+
+  // a removed and an added item are a rename only when they match each other and nothing else,
+  // ambiguous matches are dropped and created
+  let renamed =
+    removes
+    |> List.choose (fun r ->
+      match adds |> List.filter (sameStructure r) with
+      | [ a ] when removes |> List.filter (fun x -> sameStructure x a) |> List.length = 1 -> Some(r, a)
+      | _ -> None)
+
+  let ambiguity (r: 'a) =
+    match adds |> List.filter (sameStructure r) with
+    | [] -> None
+    | candidates ->
+      let names = candidates |> List.map nameSel |> String.concat ", "
+      Some $"{nameSel r} matches {names} and the rename is ambiguous, so it's dropped instead of renamed"
 
   let drops: list<SolverProposal> =
     removes
+    |> List.except (List.map fst renamed)
     |> List.map (fun r ->
-      { reason = Removed(keySel r)
-        statements = sqlDelete r })
+      { reason = Removed(nameSel r)
+        statements = sqlDelete r
+        rebuilds = None
+        warning = ambiguity r
+        destructive = false })
 
   let creates: list<SolverProposal> =
     adds
+    |> List.except (List.map snd renamed)
     |> List.map (fun r ->
-      { reason = Added(keySel r)
-        statements = sqlCreate r })
+      { reason = Added(nameSel r)
+        statements = sqlCreate r
+        rebuilds = None
+        warning = None
+        destructive = false })
 
   let renames: list<SolverProposal> =
-    common
-    |> List.choose (fun (x, y) ->
-      sqlUpdate x y
-      |> Option.map (fun xs ->
-        { reason = Changed(toString x, toString y)
-          statements = xs }))
+    renamed
+    |> List.map (fun (r, a) ->
+      { reason = Changed(nameSel r, nameSel a)
+        statements = sqlRename r a
+        rebuilds = None
+        warning = None
+        destructive = false })
 
   drops @ creates @ renames
 
+let update
+  (xs: 'a list)
+  (ys: 'a list)
+  (toString: 'a -> string)
+  (keySel: 'a -> string)
+  (sqlUpdate: 'a -> 'a -> string list option)
+  : SolverProposal list =
+  listToSet xs ys keySel
+  |> intersect
+  |> List.choose (fun (x, y) ->
+    sqlUpdate x y
+    |> Option.map (fun xs ->
+      { reason = Changed(toString x, toString y)
+        statements = xs
+        rebuilds = None
+        warning = None
+        destructive = false }))
+
+let createDeleteUpdate
+  (xs: 'a list)
+  (ys: 'a list)
+  (toString: 'a -> string)
+  (keySel: 'a -> string)
+  (sqlDelete: 'a -> string list)
+  (sqlCreate: 'a -> string list)
+  (sqlUpdate: 'a -> 'a -> string list option)
+  =
+  createDelete xs ys keySel keySel sqlDelete sqlCreate
+  @ update xs ys toString keySel sqlUpdate
+
+/// <summary>
+/// Flags dropped tables, columns and rows, since their data is lost with them
+/// </summary>
+let dropsData (p: SolverProposal) =
+  match p.reason with
+  | Removed _ -> { p with destructive = true }
+  | _ -> p
+
 let createTable (xs: CreateTable list) (ys: CreateTable list) =
-  createDelete xs ys (_.name) (_.name) Table.sqlDropTable Table.sqlCreateTable
+  let sameStructure (x: CreateTable) (y: CreateTable) =
+    Set.ofList x.columns = Set.ofList y.columns
+    && x.constraints = y.constraints
+    && x.withoutRowid = y.withoutRowid
+    && x.strict = y.strict
+
+  // a table declared as renamed from another is its only rename, regardless of their structures
+  let renamedFrom (t: CreateTable) = t.annotations.TryFind "renamed-from"
+  let claimed = ys |> List.choose renamedFrom |> Set.ofList
+
+  let renamed (x: CreateTable) (y: CreateTable) =
+    match renamedFrom y with
+    | Some from -> from = x.name
+    | None -> not (claimed.Contains x.name) && sameStructure x y
+
+  // with both sides sorted by dependencies, tables referenced by foreign keys are created before
+  // and dropped after the tables referencing them
+  createDeleteRename (List.rev xs) ys (_.name) renamed Table.sqlDropTable Table.sqlCreateTable Table.sqlRenameTable
+  |> List.map dropsData
+
+// virtual tables can't be altered, a change in their arguments drops and creates them
+let createVirtualTable (xs: CreateVirtualTable list) (ys: CreateVirtualTable list) =
+  createDeleteSorted
+    xs
+    ys
+    (_.name)
+    (Table.sqlCreateVirtualTable >> String.concat "")
+    Table.sqlDropVirtualTable
+    Table.sqlCreateVirtualTable
+  |> List.map dropsData
 
 let createView (xs: CreateView list) (ys: CreateView list) =
-  createDelete xs ys (_.name) (View.sqlCreateView >> DbUtil.joinSqlPretty) View.sqlDropView View.sqlCreateView
+  createDeleteSorted xs ys (_.name) (View.sqlCreateView >> DbUtil.joinSqlPretty) View.sqlDropView View.sqlCreateView
+
+/// <summary>
+/// Triggers whose SQL changed are dropped and created again. Their tables exist by then,
+/// since triggers are migrated after tables, views and indexes
+/// </summary>
+let createTrigger (xs: CreateTrigger list) (ys: CreateTrigger list) =
+  let keySel (t: CreateTrigger) =
+    Dependencies.sqlTokens t.sql |> String.concat " "
+
+  createDelete xs ys (_.name) keySel Trigger.sqlDropTrigger Trigger.sqlCreateTrigger
 
 let createIndex (xs: CreateIndex list) (ys: CreateIndex list) =
-  createDelete xs ys (_.table) (fun i -> $"{i.table} ON {i.columns}") Index.sqlDropIndex Index.sqlCreateIndex
+  let toString (i: CreateIndex) =
+    let unique = if i.unique then "UNIQUE " else ""
+    $"{unique}{i.name} ON {i.table}({i.columns |> Util.sepComma id}){Index.sqlWhere i}"
+
+  let sqlUpdate (x: CreateIndex) (y: CreateIndex) =
+    if x <> y then
+      Some(Index.sqlDropIndex x @ Index.sqlCreateIndex y)
+    else
+      None
+
+  createDeleteSorted xs ys (_.name) (_.name) Index.sqlDropIndex Index.sqlCreateIndex
+  @ update xs ys toString (_.name) sqlUpdate
 
-let columns (views: CreateView list) (table: CreateTable) (xs: ColumnDef list) (ys: ColumnDef list) =
+let columns
+  (rebuildRenames: bool)
+  (copyColumns: Map<string, string>)
+  (views: CreateView list)
+  (table: CreateTable)
+  (xs: ColumnDef list)
+  (ys: ColumnDef list)
+  =
   let keySel (x: ColumnDef) =
     $"{x.name} {Table.sqlColType x.columnType}"
 
-  createDeleteUpdate
-    xs
+  // a column is renamed only when it's declared with a `-- @renamed-from` comment
+  let renamed (x: ColumnDef) (y: ColumnDef) =
+    table.renamedColumns.TryFind y.name = Some x.name
+
+  // ALTER TABLE can't add STORED generated columns, the table is rebuilt with them
+  let isStored (c: ColumnDef) =
+    c.constraints
+    |> List.exists (function
+      | Generated(_, Stored) -> true
+      | _ -> false)
+
+  let sqlAddColumn (c: ColumnDef) =
+    if isStored c then
+      Table.sqlRecreateTable views table
+    else
+      Column.sqlAddColumn table.name c
+
+  let storedAdds = ys |> List.filter isStored |> List.map keySel
+
+  let markRebuild (p: SolverProposal) =
+    match p.reason with
+    | Added c when List.contains c storedAdds -> { p with rebuilds = Some table.name }
+    | _ -> p
+
+  // rebuilding copies the rows with INSERT OR IGNORE, discarding those breaking a new constraint,
+  // and a new type can convert the copied values. Defaults only apply to new rows, except for
+  // the nulls of a column becoming NOT NULL, which they replace. Without a default the copy fails
+  // on those nulls, unless copyColumns has an expression for the column
+  let losesData (x: ColumnDef) (y: ColumnDef) =
+    let breakable =
+      function
+      | Default _
+      | DefaultExpr _ -> false
+      | NotNull -> not (List.contains NotNull x.constraints) && copyColumns.ContainsKey y.name
+      | c -> not (List.contains c x.constraints)
+
+    Table.sqlColumnType x <> Table.sqlColumnType y || y.constraints |> List.exists breakable
+
+  let renames =
+    xs |> List.collect (fun x -> ys |> List.filter (renamed x) |> List.map (fun y -> x, y))
+
+  // an added column with a copy expression is filled by a rebuild that also drops and renames
+  // the other columns, so the expression can read the old ones
+  let copiesAdded =
     ys
-    Table.sqlColumnDef
-    keySel
-    (Column.sqlDropColumn table.name)
-    (Column.sqlAddColumn table.name)
-    (Column.sqlUpdateColumn views table)
+    |> List.exists (fun y ->
+      copyColumns.ContainsKey y.name
+      && not (xs |> List.exists (fun x -> x.name = y.name || renamed x y)))
+
+  let oldColumns, newColumns = xs, ys
+
+  // SQLite can't change the type of a column, the table is rebuilt converting its values
+  let retyped =
+    xs
+    |> List.choose (fun x ->
+      ys
+      |> List.tryFind (fun y -> y.name = x.name && y.columnType <> x.columnType)
+      |> Option.map (fun y -> x, y))
+
+  // SQLite before 3.25 can't rename columns, with rebuildRenames the rebuild renames them
+  let rebuiltRenames = if rebuildRenames || copiesAdded then renames else []
+  let xs = xs |> List.except (List.map fst (rebuiltRenames @ retyped))
+  let ys = ys |> List.except (List.map snd (rebuiltRenames @ retyped))
+
+  let updated =
+    listToSet xs ys keySel
+    |> intersect
+    |> List.filter (fun (x, y) -> Column.changesDefinition x y)
+
+  // the changed columns are applied by a single rebuild of the table with its new definition,
+  // copying every column from its old name and converting its values to the new type,
+  // unless copyColumns has an expression for it
+  let changed = rebuiltRenames @ retyped @ updated
+
+  let becomesNotNull (x: ColumnDef, y: ColumnDef) =
+    List.contains NotNull y.constraints && not (List.contains NotNull x.constraints)
+
+  let backfill (y: ColumnDef) =
+    y.constraints
+    |> List.tryPick (function
+      | Default v -> Some(Table.sqlDefault v)
+      | DefaultExpr e -> Some e
+      | _ -> None)
+
+  let selectColumn (c: ColumnDef) =
+    match copyColumns.TryFind c.name, changed |> List.tryFind (fun (_, y) -> y.name = c.name) with
+    | Some e, _ -> e
+    | None, Some(x, y) ->
+      let converted = Column.sqlConvert x.columnType y.columnType (Util.quoteIdent x.name)
+
+      match backfill y with
+      | Some v when becomesNotNull (x, y) -> $"COALESCE({converted}, {v})"
+      | _ -> converted
+    | None, None when xs |> List.exists (fun x -> x.name = c.name) -> Util.quoteIdent c.name
+    | None, None -> Table.sqlDefaultValue c
+
+  // nulls without a value to replace them make the copy fail, instead of discarding their rows
+  let recreate =
+    if
+      changed
+      |> List.exists (fun (x, y) -> becomesNotNull (x, y) && not (copyColumns.ContainsKey y.name) && (backfill y).IsNone)
+    then
+      Table.sqlRecreateTableInserting "INSERT INTO"
+    else
+      Table.sqlRecreateTableWith
+
+  let rebuild =
+    match changed with
+    | _ when copiesAdded ->
+      [ { reason = Changed(oldColumns |> Util.sepComma Table.sqlColumnDef, newColumns |> Util.sepComma Table.sqlColumnDef)
+          statements = recreate views table selectColumn
+          rebuilds = Some table.name
+          warning = None
+          destructive =
+            changed |> List.exists (fun (x, y) -> losesData x y)
+            || xs |> List.exists (fun x -> ys |> List.forall (fun y -> y.name <> x.name)) } ]
+    | [] -> []
+    | pairs ->
+      [ { reason = Changed(pairs |> Util.sepComma (fst >> Table.sqlColumnDef), pairs |> Util.sepComma (snd >> Table.sqlColumnDef))
+          statements = recreate views table selectColumn
+          rebuilds = Some table.name
+          warning = None
+          destructive = pairs |> List.exists (fun (x, y) -> losesData x y) } ]
+
+  let dropAdd =
+    if copiesAdded then
+      []
+    elif rebuildRenames then
+      createDelete xs ys keySel keySel (Column.sqlDropColumn table.name) sqlAddColumn
+    else
+      createDeleteRename
+        xs
+        ys
+        keySel
+        renamed
+        (Column.sqlDropColumn table.name)
+        sqlAddColumn
+        (Column.sqlRenameColumn table.name)
+
+  (dropAdd |> List.map (markRebuild >> dropsData)) @ rebuild
 
 let constraints (views: CreateView list) (right: CreateTable) (xs: ColumnConstraint list) (ys: ColumnConstraint list) =
   let keySel = Table.sqlConstraint
   let constraintSolution _ = Table.sqlRecreateTable views right
 
+  // a removed constraint keeps every row, an added one discards the rows breaking it
   createDelete xs ys keySel keySel constraintSolution constraintSolution
+  |> List.map (fun p ->
+    { p with
+        rebuilds = Some right.name
+        destructive =
+          match p.reason with
+          | Added _ -> true
+          | _ -> false })
+
+let tableOptions (views: CreateView list) (left: CreateTable) (right: CreateTable) =
+  // table options can't be altered, the table is rebuilt with the new ones
+  if Table.sqlTableOptions left <> Table.sqlTableOptions right then
+    [ { reason = Changed($"{left.name}{Table.sqlTableOptions left}", $"{right.name}{Table.sqlTableOptions right}")
+        statements = Table.sqlRecreateTable views right
+        rebuilds = Some right.name
+        warning = None
+        // STRICT tables reject values of other types, and WITHOUT ROWID ones null primary keys
+        destructive = (right.strict && not left.strict) || (right.withoutRowid && not left.withoutRowid) } ]
+  else
+    []
 
 let insertInto (keyIndexes: int list) (left: InsertInto) (right: InsertInto) =
 
@@ -145,6 +435,8 @@ let insertInto (keyIndexes: int list) (left: InsertInto) (right: InsertInto) =
     |> List.map (fun i -> xs[i])
     |> List.map (function
       | Integer i -> $"{i}"
+      | Real r -> $"{r}"
+      | Blob b -> System.Convert.ToHexString b
       | String s -> s)
     |> String.concat "|"
 
@@ -162,6 +454,7 @@ let insertInto (keyIndexes: int list) (left: InsertInto) (right: InsertInto) =
     else
       None
 
+  // only deleted rows lose data, updated ones take the values declared in the project
   createDeleteUpdate
     left.values
     right.values
@@ -170,3 +463,4 @@ let insertInto (keyIndexes: int list) (left: InsertInto) (right: InsertInto) =
     (Row.sqlDeleteRow right keyIndexes)
     (Row.sqlInsertRow right)
     toUpdate
+  |> List.map dropsData
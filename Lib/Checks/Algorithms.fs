@@ -12,22 +12,113 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
-module internal Migrate.Checks.Algorithms
+module Migrate.Checks.Algorithms
+
+open System.Collections.Generic
+
+/// <summary>
+/// Sorts xs so every node comes after the nodes it references, or returns Error with the
+/// nodes that couldn't be sorted: those in a cycle and the ones the cycle references
+/// </summary>
+/// <example>
+/// <code>
+/// let deps = Map.ofList [ "view0", [ "table0" ]; "table0", [ "table1" ]; "table1", [] ]
+/// topologicalSortChecked (fun x -> deps[x]) [ "view0"; "table0"; "table1" ]
+/// // Ok [ "table1"; "table0"; "view0" ]
+/// </code>
+/// </example>
+let topologicalSortChecked reference xs =
+  let graph = xs |> List.map (fun x -> x, reference x |> List.distinct) |> Map.ofList
+  let referrers = Dictionary<_, int>(HashIdentity.Structural)
+
+  for deps in graph.Values do
+    for d in deps |> List.filter graph.ContainsKey do
+      referrers[d] <- (if referrers.ContainsKey d then referrers[d] else 0) + 1
+
+  // nodes nobody references, the result is built backwards so taking the greatest one
+  // leaves independent nodes in alphabetical order
+  let ready = SortedSet<_>(ComparisonIdentity.Structural)
+
+  for k in graph.Keys |> Seq.filter (referrers.ContainsKey >> not) do
+    ready.Add k |> ignore
 
-let topologicalSort reference xs =
-  let mutable graph = xs |> List.map (fun x -> (x, reference x)) |> Map.ofList
   let mutable result = []
 
-  while graph.Count > 0 do
-    let node =
-      graph
-      |> Map.filter (fun key _ -> not (graph |> Map.exists (fun _ v -> List.contains key v)))
-      |> Map.tryFindKey (fun _ _ -> true)
+  while ready.Count > 0 do
+    let node = ready.Max
+    ready.Remove node |> ignore
+    result <- node :: result
+
+    for d in graph[node] |> List.filter graph.ContainsKey do
+      referrers[d] <- referrers[d] - 1
+
+      if referrers[d] = 0 then
+        ready.Add d |> ignore
+
+  if result.Length = graph.Count then
+    Ok result
+  else
+    let sorted = Set.ofList result
+    graph.Keys |> Seq.filter (sorted.Contains >> not) |> Seq.toList |> Error
+
+/// <summary>
+/// Like topologicalSortChecked, failing when the nodes have a cycle
+/// </summary>
+let topologicalSort reference xs =
+  match topologicalSortChecked reference xs with
+  | Ok result -> result
+  | Error _ -> failwith "The graph has a cycle"
+
+/// <summary>
+/// Groups xs in strongly connected components, the nodes referencing each other directly or
+/// through other nodes. A node in no cycle makes a component by itself
+/// </summary>
+/// <example>
+/// <code>
+/// let deps = Map.ofList [ "a", [ "b" ]; "b", [ "a" ]; "c", [ "a" ] ]
+/// stronglyConnected (fun x -> deps[x]) [ "a"; "b"; "c" ]
+/// // [ [ "c" ]; [ "a"; "b" ] ]
+/// </code>
+/// </example>
+let stronglyConnected reference xs =
+  let index = Dictionary<_, int>(HashIdentity.Structural)
+  let lowLink = Dictionary<_, int>(HashIdentity.Structural)
+  let onStack = HashSet<_>(HashIdentity.Structural)
+  let stack = Stack<_>()
+  // depth first search with an explicit stack of the nodes in the path and their references left,
+  // so long chains don't overflow the call stack
+  let path = Stack<_>()
+  let mutable components = []
+
+  let visit n =
+    index[n] <- index.Count
+    lowLink[n] <- index[n]
+    stack.Push n
+    onStack.Add n |> ignore
+    path.Push(n, reference n)
+
+  let rec popComponent n acc =
+    let m = stack.Pop()
+    onStack.Remove m |> ignore
+    if m = n then m :: acc else popComponent n (m :: acc)
+
+  for x in xs do
+    if not (index.ContainsKey x) then
+      visit x
+
+    while path.Count > 0 do
+      match path.Pop() with
+      | n, r :: rest ->
+        path.Push(n, rest)
+
+        if not (index.ContainsKey r) then visit r
+        elif onStack.Contains r then lowLink[n] <- min lowLink[n] index[r]
+      | n, [] ->
+        if path.Count > 0 then
+          let parent, _ = path.Peek()
+          lowLink[parent] <- min lowLink[parent] lowLink[n]
 
-    match node with
-    | Some node ->
-      result <- node :: result
-      graph <- graph |> Map.remove node
-    | None -> failwith "The graph has a cycle"
+        if lowLink[n] = index[n] then
+          components <- popComponent n [] :: components
 
-  result
+  components
@@ -0,0 +1,108 @@
+// Copyright 2023 Luis Ángel Méndez Gort
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+module internal Migrate.Checks.Lint
+
+open System.Text.RegularExpressions
+open Migrate.Types
+
+/// <summary>
+/// Column an index column specification refers to, without its collation or sort order.
+/// Expressions don't refer to a single column
+/// </summary>
+let indexedColumn (spec: string) =
+  let m =
+    Regex.Match(spec, @"^\s*(""[^""]+""|\w+)\s*(?:COLLATE\s+\w+\s*)?(?:ASC|DESC)?\s*$", RegexOptions.IgnoreCase)
+
+  if m.Success then Some(m.Groups[1].Value.Trim '"') else None
+
+/// <summary>
+/// Leading columns of every index SQLite keeps for a table: the ones declared with CREATE INDEX
+/// and the automatic ones of PRIMARY KEY and UNIQUE constraints
+/// </summary>
+let tableIndexes (file: SqlFile) (table: CreateTable) =
+  let declared =
+    file.indexes
+    |> List.filter (fun i -> i.table = table.name)
+    |> List.map (fun i -> i.columns |> List.map indexedColumn |> List.takeWhile Option.isSome |> List.choose id)
+
+  let columnConstraints =
+    table.columns
+    |> List.collect (fun c ->
+      c.constraints
+      |> List.choose (function
+        | PrimaryKey []
+        | Unique [] -> Some [ c.name ]
+        | _ -> None))
+
+  let tableConstraints =
+    table.constraints
+    |> List.choose (function
+      | PrimaryKey xs
+      | Unique xs when not xs.IsEmpty -> Some xs
+      | _ -> None)
+
+  declared @ columnConstraints @ tableConstraints
+
+let unindexedForeignKeys (file: SqlFile) (table: CreateTable) =
+  let indexes = tableIndexes file table
+
+  // SQLite looks up the rows referencing a deleted or updated one with an index starting
+  // with the foreign key columns, in any order
+  let covered (columns: string list) =
+    indexes
+    |> List.exists (fun ix ->
+      ix.Length >= columns.Length
+      && Set.ofList (List.take columns.Length ix) = Set.ofList columns)
+
+  let foreignKeys =
+    (table.constraints
+     |> List.choose (function
+       | ForeignKey fk -> Some fk.columns
+       | _ -> None))
+    @ (table.columns
+       |> List.collect (fun c ->
+         c.constraints
+         |> List.choose (function
+           | ForeignKey _ -> Some [ c.name ]
+           | _ -> None)))
+
+  foreignKeys
+  |> List.filter (covered >> not)
+  |> List.map (fun columns -> UnindexedForeignKey(table.name, columns))
+
+// unique and partial indexes do more than speeding up queries, they aren't reported
+let redundantIndexes (file: SqlFile) =
+  let plain = file.indexes |> List.filter (fun i -> not i.unique && i.where.IsNone)
+
+  let covers (i: CreateIndex) (j: CreateIndex) =
+    i.name <> j.name
+    && i.table = j.table
+    && i.columns.Length <= j.columns.Length
+    && List.take i.columns.Length j.columns = i.columns
+    // of two identical plain indexes only the one with the greatest name is reported
+    && (i.columns.Length < j.columns.Length || j.unique || i.name > j.name)
+
+  plain
+  |> List.collect (fun i ->
+    file.indexes
+    |> List.filter (fun j -> j.where.IsNone && covers i j)
+    |> List.truncate 1
+    |> List.map (fun j -> RedundantIndex(i.name, j.name)))
+
+/// <summary>
+/// Advisory warnings about the schema in file, which don't prevent migrating it
+/// </summary>
+let lint (file: SqlFile) =
+  (file.tables |> List.collect (unindexedForeignKeys file)) @ redundantIndexes file
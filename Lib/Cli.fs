@@ -15,6 +15,7 @@
 module Migrate.Cli
 
 open System.IO
+open System.Text.RegularExpressions
 open Migrate.Reports
 open Migrate.Types
 open Migrate.Execution
@@ -44,6 +45,12 @@ let commit p =
   | StaleMigration xs ->
     Print.printRed $"Stale migration {xs}"
     1
+  | DependencyCycle cycle ->
+    Print.printRed $"Relations {cycle} depend on each other"
+    1
+  | MissingDependencies(relations, dependencies) ->
+    Print.printRed $"Relations {relations} depend on undefined relations {dependencies}"
+    1
   | ExpectingEnvVar x ->
     Print.printError $"Expecting environment variable {x}"
     1
@@ -71,6 +78,12 @@ let commitAmend p =
   | StaleMigration xs ->
     Print.printRed $"Stale migration {xs}"
     1
+  | DependencyCycle cycle ->
+    Print.printRed $"Relations {cycle} depend on each other"
+    1
+  | MissingDependencies(relations, dependencies) ->
+    Print.printRed $"Relations {relations} depend on undefined relations {dependencies}"
+    1
   | ExpectingEnvVar x ->
     Print.printError $"Expecting environment variable {x}"
     1
@@ -100,6 +113,12 @@ let manualMigration p =
   | StaleMigration xs ->
     Print.printRed $"Stale migration {xs}"
     1
+  | DependencyCycle cycle ->
+    Print.printRed $"Relations {cycle} depend on each other"
+    1
+  | MissingDependencies(relations, dependencies) ->
+    Print.printRed $"Relations {relations} depend on undefined relations {dependencies}"
+    1
   | ExpectingEnvVar x ->
     Print.printError $"Expecting environment variable {x}"
     1
@@ -138,10 +157,232 @@ let status p =
   | StaleMigration xs ->
     Print.printRed $"Stale migration {xs}"
     1
+  | DependencyCycle cycle ->
+    Print.printRed $"Relations {cycle} depend on each other"
+    1
+  | MissingDependencies(relations, dependencies) ->
+    Print.printRed $"Relations {relations} depend on undefined relations {dependencies}"
+    1
   | ExpectingEnvVar x ->
     Print.printError $"Expecting environment variable {x}"
     1
 
+/// <summary>
+/// Options producing the same statements as `migrationSql`, except for foreign keys being disabled
+/// around rebuilds of the tables they reference
+/// </summary>
+let defaultMigrationOptions =
+  { ifNotExists = false
+    transaction = false
+    rebuildRenamedColumns = false
+    quoteStyle = DoubleQuotes
+    temporary = false
+    copyColumns = Map.empty
+    analyze = false }
+
+let private migrationProposals (options: MigrationOptions) (current: string) (desired: string) =
+  match Migrate.SqlParser.parseSql "current" current, Migrate.SqlParser.parseSql "desired" desired with
+  | Ok current, Ok desired ->
+    try
+      let temporary =
+        if options.temporary then
+          Calculation.Migration.temporaryMigration desired
+          |> List.map (fun s ->
+            { reason = s.reason
+              statements = s.statements
+              error = None
+              rebuilds = s.rebuilds
+              warning = s.warning
+              destructive = s.destructive })
+        else
+          []
+
+      let steps =
+        Commit.migrationProposals options.rebuildRenamedColumns options.copyColumns current desired
+
+      // statements are validated by executing them on a temporary database,
+      // the ones SQLite rejects in any step are returned as errors
+      match steps |> List.choose _.error with
+      | [] -> steps @ temporary |> Ok
+      | errors -> errors |> String.concat "\n" |> Error
+    with
+    | FailedQuery e -> Error $"Replicating the current schema: {e.sql} -> {e.error}"
+    | MissingDependencies(relations, dependencies) ->
+      Error $"Relations {relations} depend on undefined relations {dependencies}"
+    | DependencyCycle cycle -> Error $"Relations {cycle} depend on each other"
+    | StaleMigration xs ->
+      match xs |> List.choose _.error with
+      | [] -> Error $"Stale migration {xs}"
+      | errors -> errors |> String.concat "\n" |> Error
+  | Error e, _
+  | _, Error e -> Error e
+
+/// <summary>
+/// Statements migrating a database with the schema in `current` to the one in `desired`.
+/// They are the result of executing the migration steps on a temporary database, so each statement
+/// can rely on the ones before it. Within a step tables come first, then column renames, views, columns,
+/// constraints, indexes and inserts, and relations are created after the ones they depend on.
+/// Statements rejected by SQLite result in an error with them and the reason they failed
+/// </summary>
+let migrationSql (current: string) (desired: string) =
+  migrationProposals defaultMigrationOptions current desired
+  |> Result.map (List.collect _.statements)
+
+/// <summary>
+/// Matches the tables and columns of two schemas by name
+/// </summary>
+let defaultDiffer = Calculation.Migration.defaultDiffer
+
+/// <summary>
+/// Tables, columns, views and indexes added, removed or changed from `current` to `desired`,
+/// with differ deciding which tables and columns of both schemas are the same
+/// </summary>
+let compareSchemasWith (differ: Differ) (current: string) (desired: string) =
+  match Migrate.SqlParser.parseSql "current" current, Migrate.SqlParser.parseSql "desired" desired with
+  | Ok current, Ok desired -> Calculation.Migration.compareSchemasWith differ current desired |> Ok
+  | Error e, _
+  | _, Error e -> Error e
+
+/// <summary>
+/// Tables, columns, views and indexes added, removed or changed from `current` to `desired`
+/// </summary>
+let compareSchemas (current: string) (desired: string) = compareSchemasWith defaultDiffer current desired
+
+/// <summary>
+/// Advisory warnings about the schema in `sql`: foreign keys without an index to look up
+/// the rows referencing a deleted or updated one, and indexes made redundant by others
+/// </summary>
+let lintSql (sql: string) =
+  Migrate.SqlParser.parseSql "schema" sql |> Result.map Checks.Lint.lint
+
+/// <summary>
+/// Like `migrationSql`, with every statement flagged when it can lose data and paired with the
+/// reason for it, so they can be reviewed before being applied
+/// </summary>
+let annotatedMigrationSql (current: string) (desired: string) =
+  migrationProposals defaultMigrationOptions current desired
+  |> Result.map (List.collect (fun p -> Calculation.Migration.annotateStatements p.reason p.destructive p.statements))
+
+/// <summary>
+/// Statements reverting the migration from `current` to `desired`: created relations are dropped,
+/// added columns removed and renames reversed. They come with the forward statements that lose data,
+/// like dropped tables and columns, since reverting recreates them empty
+/// </summary>
+let migrationSqlDown (current: string) (desired: string) =
+  match annotatedMigrationSql current desired, migrationSql desired current with
+  | Ok forward, Ok reverting ->
+    { reverting = reverting
+      irreversible = forward |> List.filter _.destructive }
+    |> Ok
+  | Error e, _
+  | _, Error e -> Error e
+
+/// <summary>
+/// The statements of `annotatedMigrationSql` as JSON, for tools reviewing migrations before they are applied
+/// </summary>
+let migrationPlanJson (current: string) (desired: string) =
+  annotatedMigrationSql current desired |> Result.map Calculation.Migration.planJson
+
+/// <summary>
+/// Steps migrating `current` to `desired`, each one with its reason and statements, so they can be
+/// inspected before rendering them with `renderMigrationPlan`. Only the options choosing the steps
+/// are used here: `rebuildRenamedColumns`, `copyColumns` and `temporary`
+/// </summary>
+let migrationPlanWith (options: MigrationOptions) (current: string) (desired: string) =
+  let referenced =
+    Migrate.SqlParser.parseSql "desired" desired
+    |> Result.map (fun f -> f.tables |> List.collect Calculation.Dependencies.tableReferences |> Set.ofList)
+
+  match migrationProposals options current desired, referenced with
+  | Ok steps, Ok referenced ->
+    Ok
+      { steps = steps
+        referencedTables = referenced }
+  | Error e, _
+  | _, Error e -> Error e
+
+/// <summary>
+/// Steps producing the statements of `migrationSql`
+/// </summary>
+let migrationPlan (current: string) (desired: string) =
+  migrationPlanWith defaultMigrationOptions current desired
+
+/// <summary>
+/// Statements of the plan adjusted according to `options`
+/// </summary>
+let renderMigrationPlan (options: MigrationOptions) (plan: MigrationPlan) =
+  let adjust (p: ProposalResult) =
+    match p.rebuilds with
+    | Some table when options.ifNotExists ->
+      // a rebuild interrupted before renaming its auxiliary table leaves it behind, and running it
+      // again must start from an empty one rather than skip creating it
+      $"DROP TABLE IF EXISTS {SqlGeneration.Util.quoteIdent $"{table}_aux"}" :: p.statements
+    | None when options.ifNotExists -> p.statements |> List.map SqlGeneration.Util.sqlIfNotExists
+    | _ -> p.statements
+
+  // dropping a table referenced by foreign keys while rebuilding it would delete or reject the rows
+  // referencing it. Foreign keys are disabled around the rebuild, and foreign_key_check reports the
+  // references the new table breaks
+  let rebuildsReferenced (p: ProposalResult) =
+    p.rebuilds |> Option.exists plan.referencedTables.Contains
+
+  let foreignKeys (p: ProposalResult) (xs: string list) =
+    match rebuildsReferenced p, options.transaction with
+    | true, true -> xs @ [ "PRAGMA foreign_key_check" ]
+    | true, false -> [ "PRAGMA foreign_keys=OFF" ] @ xs @ [ "PRAGMA foreign_key_check"; "PRAGMA foreign_keys=ON" ]
+    | false, _ -> xs
+
+  let analyze (xs: string list) =
+    let changesIndex (sql: string) =
+      Regex.IsMatch(sql, "^(CREATE (UNIQUE )?INDEX|DROP INDEX) ")
+
+    if options.analyze && List.exists changesIndex xs then
+      xs @ [ "ANALYZE" ]
+    else
+      xs
+
+  // SQLite ignores the foreign_keys pragma inside a transaction, it goes around it
+  let transaction (foreignKeysOff: bool) (xs: string list) =
+    match options.transaction, foreignKeysOff with
+    | true, true -> [ "PRAGMA foreign_keys=OFF"; "BEGIN TRANSACTION" ] @ xs @ [ "COMMIT"; "PRAGMA foreign_keys=ON" ]
+    | true, false -> [ "BEGIN TRANSACTION" ] @ xs @ [ "COMMIT" ]
+    | false, _ -> xs
+
+  let quote (xs: string list) =
+    match options.quoteStyle with
+    | DoubleQuotes -> xs
+    | Backticks -> xs |> List.map SqlGeneration.Util.sqlBackticks
+
+  plan.steps
+  |> List.collect (fun p -> adjust p |> foreignKeys p)
+  |> analyze
+  |> transaction (plan.steps |> List.exists rebuildsReferenced)
+  |> quote
+
+/// <summary>
+/// Like `migrationSql`, with the generated statements adjusted according to `options`
+/// </summary>
+let migrationSqlWithOptions (options: MigrationOptions) (current: string) (desired: string) =
+  migrationPlanWith options current desired |> Result.map (renderMigrationPlan options)
+
+/// <summary>
+/// Statements joined in a script, with a line for every column and table constraint
+/// of CREATE TABLE statements. The other statements are kept as they are
+/// </summary>
+let formatSql (statements: string list) =
+  statements
+  |> List.map (fun sql ->
+    match Migrate.SqlParser.parseSql "statement" sql with
+    | Ok { tables = [ table ]
+           views = []
+           indexes = []
+           inserts = []
+           virtualTables = []
+           triggers = [] } ->
+      SqlGeneration.Table.sqlCreateTableFormatted table
+    | _ -> sql)
+  |> DbUtil.joinSql
+
 /// <summary>
 /// Shows the current database schema
 /// </summary>
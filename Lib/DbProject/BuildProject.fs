@@ -22,7 +22,9 @@ let collectSql (xs: SqlFile list) =
     { inserts = []
       tables = []
       views = []
-      indexes = [] }
+      indexes = []
+      virtualTables = []
+      triggers = [] }
 
   xs
   |> List.fold
@@ -30,7 +32,9 @@ let collectSql (xs: SqlFile list) =
       { inserts = acc.inserts @ n.inserts
         tables = acc.tables @ n.tables
         views = acc.views @ n.views
-        indexes = acc.indexes @ n.indexes })
+        indexes = acc.indexes @ n.indexes
+        virtualTables = acc.virtualTables @ n.virtualTables
+        triggers = acc.triggers @ n.triggers })
     r
 
 let mergeTomlSql (p: DbTomlFile) (src: SqlFile) =
@@ -43,11 +47,21 @@ let mergeTomlSql (p: DbTomlFile) (src: SqlFile) =
     schemaVersion = p.schemaVersion }
 
 let buildProject (reader: string -> string * string) (p: DbTomlFile) =
-  let parse (file, sql) =
-    match parseSql file sql with
-    | Ok p -> p
-    | Error e -> MalformedProject e |> raise
-
-  let fileContent = p.files |> List.map reader
-  let sql = fileContent |> List.map parse
-  sql |> collectSql |> mergeTomlSql p
+  let parsed = p.files |> List.map (reader >> fun (file, sql) -> parseSql file sql)
+
+  let errors =
+    parsed
+    |> List.choose (function
+      | Error e -> Some e
+      | Ok _ -> None)
+
+  // every malformed file is reported at once, instead of only the first one
+  match errors with
+  | [] ->
+    parsed
+    |> List.choose (function
+      | Ok f -> Some f
+      | Error _ -> None)
+    |> collectSql
+    |> mergeTomlSql p
+  | _ -> errors |> String.concat "\n" |> MalformedProject |> raise
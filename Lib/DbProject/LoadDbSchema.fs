@@ -42,12 +42,27 @@ let relationValues (conn: SqliteConnection) (relation: string) (cols: string lis
     columns = cols
     values = vss }
 
+/// <summary>
+/// Value of a column with numeric affinity, which keeps integers and reals, and the text or blobs
+/// that aren't numbers
+/// </summary>
+let numericValue (v: obj) =
+  match v with
+  | :? int64 as i -> int i |> Integer
+  | :? double as r -> Real r
+  | :? string as s -> String s
+  | :? (byte array) as b -> Blob b
+  | v -> failwith $"unsupported numeric value {v}"
+
 let rowReader (xs: SqlType list) (rd: IDataReader) =
   xs
   |> List.mapi (fun i c ->
     match c with
     | SqlText -> rd.GetString i |> String
-    | SqlInteger -> rd.GetInt32 i |> Integer)
+    | SqlInteger -> rd.GetInt32 i |> Integer
+    | SqlReal -> rd.GetDouble i |> Real
+    | SqlBlob -> rd.GetValue i :?> byte array |> Blob
+    | SqlNumeric _ -> rd.GetValue i |> numericValue)
 
 let tableValues (conn: SqliteConnection) (ct: CreateTable) =
   let cols = ct.columns |> List.map _.name
@@ -70,7 +85,7 @@ let searchTable (f: SqlFile) (name: string) =
 let searchColumns (f: SqlFile) (table: string) =
   searchTable f table |> Option.map (fun t -> t.columns)
 
-type SqliteMaster = { sql: string }
+type SqliteMaster = { name: string; sql: string }
 let sqliteMaster = table'<SqliteMaster> "sqlite_master"
 
 [<Literal>]
@@ -87,12 +102,49 @@ let sqliteMasterStatements (conn: SqliteConnection) =
   |> Async.RunSynchronously
   |> Seq.toList
 
+/// <summary>
+/// Tables in rows named after a virtual table in them followed by _, like docs_data for
+/// the fts5 table docs, which is how modules name their shadow tables
+/// </summary>
+let shadowTablesByName (rows: SqliteMaster list) =
+  let virtualTables =
+    rows
+    |> List.filter _.sql.StartsWith("CREATE VIRTUAL TABLE", System.StringComparison.OrdinalIgnoreCase)
+    |> List.map _.name
+
+  rows
+  |> List.filter (fun r -> virtualTables |> List.exists (fun v -> r.name.StartsWith $"{v}_"))
+  |> List.map _.name
+  |> Set.ofList
+
+// virtual tables keep their content in shadow tables, created and dropped along with them.
+// SQLite reports them in pragma_table_list since 3.37, before it they're recognized by their names
+let shadowTables (conn: SqliteConnection) (rows: SqliteMaster list) =
+  try
+    let c = conn.CreateCommand()
+    c.CommandText <- "SELECT name FROM pragma_table_list WHERE type = 'shadow'"
+    use rd = c.ExecuteReader()
+
+    seq {
+      while rd.Read() do
+        yield rd.GetString 0
+    }
+    |> Set.ofSeq
+  with :? SqliteException ->
+    shadowTablesByName rows
+
 let dbSchemaList (conn: SqliteConnection) =
   let noneIsSubStr (xs: string list) (x: string) = xs |> List.exists x.Contains |> not
+  let rows = sqliteMasterStatements conn
+  let shadow = shadowTables conn rows
 
-  sqliteMasterStatements conn
+  rows
   |> List.choose (function
-    | { sql = sql } when noneIsSubStr [ "sqlite_sequence"; migrateTablePrefix ] sql -> Some sql
+    | { name = name; sql = sql } when
+      noneIsSubStr [ "sqlite_sequence"; migrateTablePrefix ] sql
+      && not (shadow.Contains name)
+      ->
+      Some sql
     | _ -> None)
 
 let rawDbSchema (conn: SqliteConnection) = dbSchemaList conn |> joinSqlPretty
@@ -102,7 +154,9 @@ let dbSchema (p: Project) (conn: SqliteConnection) =
     { tables = []
       views = []
       inserts = []
-      indexes = [] }
+      indexes = []
+      virtualTables = []
+      triggers = [] }
 
   let schema =
     dbSchemaList conn
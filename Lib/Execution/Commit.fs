@@ -24,17 +24,26 @@ open Spectre.Console
 open Migrate.Execution
 
 let replicateInDb (schema: SqlFile) (dbFile: string) =
+  let schema = Migrate.Calculation.Dependencies.sortFile schema
 
   let tables = schema.tables |> List.map Table.sqlCreateTable
 
+  let virtualTables = schema.virtualTables |> List.map Table.sqlCreateVirtualTable
+
   let views = schema.views |> List.map View.sqlCreateView
 
   let inserts = schema.inserts |> List.map InsertInto.sqlInsertInto
 
   let indexes = schema.indexes |> List.map Index.sqlCreateIndex
 
+  // triggers come last, so they don't fire while the rows of the schema are inserted
+  let triggers = schema.triggers |> List.map Trigger.sqlCreateTrigger
+
   let sql =
-    [ tables; views; inserts; indexes ] |> List.concat |> List.concat |> joinSql
+    [ tables; virtualTables; views; inserts; indexes; triggers ]
+    |> List.concat
+    |> List.concat
+    |> joinSql
 
   use conn = openConn dbFile
   conn.Open()
@@ -44,32 +53,57 @@ let replicateInDb (schema: SqlFile) (dbFile: string) =
     Store.Init.initStore conn
     runSql conn sql
     tx.Commit()
-  with e ->
+  with _ ->
     tx.Rollback()
-    Print.printRed e.Message
+    reraise ()
 
 let parseVersion (version: string) = SemanticVersion.TryParse version
 
-let migrateStep (p: Project) (conn: SqliteConnection) : ProposalResult list option =
+let migrateStepWith
+  (rebuildRenames: bool)
+  (copyColumns: Map<string, Map<string, string>>)
+  (p: Project)
+  (conn: SqliteConnection)
+  : ProposalResult list option =
   let schema = Migrate.DbProject.LoadDbSchema.dbSchema p conn
 
-  Migrate.Calculation.Migration.migration schema p
+  Migrate.Calculation.Migration.migrationWith rebuildRenames copyColumns schema p
   |> Option.map (fun statements ->
 
     statements
     |> List.map (fun s ->
+      // a failed step is rolled back, so a table rebuild stopped half way doesn't leave its auxiliary table
+      runSql conn "SAVEPOINT migration_step"
+
       try
         s.statements |> List.iter (runSql conn)
+        runSql conn "RELEASE migration_step"
 
         { reason = s.reason
           statements = s.statements
-          error = None }
+          error = None
+          rebuilds = s.rebuilds
+          warning = s.warning
+          destructive = s.destructive }
       with FailedQuery e ->
+        runSql conn "ROLLBACK TO migration_step"
+        runSql conn "RELEASE migration_step"
+
         { reason = s.reason
           statements = s.statements
-          error = Some $"{e.sql} -> {e.error}" }))
-
-let migrateDb (p: Project) (conn: SqliteConnection) =
+          error = Some $"{e.sql} -> {e.error}"
+          rebuilds = s.rebuilds
+          warning = s.warning
+          destructive = s.destructive }))
+
+let migrateStep = migrateStepWith false Map.empty
+
+let migrateDbWith
+  (rebuildRenames: bool)
+  (copyColumns: Map<string, Map<string, string>>)
+  (p: Project)
+  (conn: SqliteConnection)
+  =
   let mutable stop = false
   let mutable steps = ResizeArray<ProposalResult>()
   let mutable last = []
@@ -79,7 +113,7 @@ let migrateDb (p: Project) (conn: SqliteConnection) =
   while not stop do
     i <- i + 1
 
-    match migrateStep p conn with
+    match migrateStepWith rebuildRenames copyColumns p conn with
     | Some xs when steps.Count > 0 && xs = last -> StaleMigration xs |> raise
     | Some xs ->
       last <- xs
@@ -88,6 +122,8 @@ let migrateDb (p: Project) (conn: SqliteConnection) =
 
   steps |> List.ofSeq
 
+let migrateDb = migrateDbWith false Map.empty
+
 type VersionStatus =
   { shouldMigrate: bool
     projectVersion: SemanticVersion
@@ -119,22 +155,80 @@ let nothingToMigrate
   printfn $"Latest project version: {pv}"
   printfn $"Latest database version: {sv}"
 
+let private removeTempDir (dir: System.IO.DirectoryInfo) =
+  // pooled connections keep the database file open
+  SqliteConnection.ClearAllPools()
+  dir.Delete true
+
 let createTempDb (schema: SqlFile) (filename: string) =
   let filename = System.IO.Path.GetFileName filename
   let migDir = System.IO.Directory.CreateTempSubdirectory "migrate"
   let testDb = System.IO.Path.Combine(migDir.FullName, filename)
-  replicateInDb schema testDb
-  testDb
+
+  try
+    replicateInDb schema testDb
+    testDb
+  with _ ->
+    removeTempDir migDir
+    reraise ()
+
+/// <summary>
+/// Calls f with a temporary database replicating schema, removed with its directory afterwards
+/// </summary>
+let withTempDb (schema: SqlFile) (filename: string) (f: string -> 'a) =
+  let tempDb = createTempDb schema filename
+
+  try
+    f tempDb
+  finally
+    System.IO.Path.GetDirectoryName tempDb |> System.IO.DirectoryInfo |> removeTempDir
+
+let migrationProposals
+  (rebuildRenames: bool)
+  (copyColumns: Map<string, Map<string, string>>)
+  (current: SqlFile)
+  (desired: SqlFile)
+  =
+  withTempDb current "migration.sqlite3" (fun tempDb ->
+    use conn = openConn tempDb
+
+    let p =
+      { dbFile = tempDb
+        source = desired
+        syncs = []
+        reports = []
+        pullScript = None
+        schemaVersion = "0.0.0"
+        versionRemarks = "" }
+
+    migrateDbWith rebuildRenames copyColumns p conn)
+
+let migrationStatements (current: SqlFile) (desired: SqlFile) =
+  migrationProposals false Map.empty current desired |> List.collect _.statements
 
 let execManualMigration (p: Project) (conn: SqliteConnection) (sql: string) =
   let schema = Migrate.DbProject.LoadDbSchema.dbSchema p conn
 
-  let tempFile = createTempDb schema p.dbFile
-  use tempConn = openConn tempFile
-
-  runSql tempConn sql
-  let actual = DbProject.LoadDbSchema.dbSchema { p with dbFile = tempFile } tempConn
-  let expected = p.source
+  let actual =
+    withTempDb schema p.dbFile (fun tempFile ->
+      use tempConn = openConn tempFile
+      runSql tempConn sql
+      DbProject.LoadDbSchema.dbSchema { p with dbFile = tempFile } tempConn)
+
+  // annotations tell migrations how to get to the schema, they aren't part of it,
+  // and column comments written by the manual migration don't change the schema
+  let withoutAnnotations (f: SqlFile) =
+    { f with
+        tables =
+          f.tables
+          |> List.map (fun t ->
+            { t with
+                renamedColumns = Map.empty
+                annotations = Map.empty
+                columnComments = Map.empty }) }
+
+  let actual = withoutAnnotations actual
+  let expected = withoutAnnotations p.source
 
   if actual <> expected then
     Print.printRed
@@ -152,7 +246,10 @@ let execManualMigration (p: Project) (conn: SqliteConnection) (sql: string) =
         steps =
           [ { reason = Added "Manual migration"
               statements = [ sql ]
-              error = None } ] }
+              error = None
+              rebuilds = None
+              warning = None
+              destructive = false } ] }
 
     Store.Insert.storeMigration conn m
 
@@ -206,6 +303,8 @@ let migrateAndCommit (p: Project) =
       match xs with
       | [] -> nothingToMigrate vs
       | steps ->
+        Store.Print.printWarnings steps
+
         Store.Insert.storeMigration
           conn
           { steps = steps
@@ -245,31 +344,31 @@ let dryMigration (p: Project) =
   use conn = openConn p.dbFile
   let schema = Migrate.DbProject.LoadDbSchema.dbSchema p conn
 
-  let tempFile = createTempDb schema p.dbFile
-  use tempConn = openConn tempFile
+  withTempDb schema p.dbFile (fun tempFile ->
+    use tempConn = openConn tempFile
 
-  use tx = conn.BeginTransaction()
-  use tempTx = tempConn.BeginTransaction()
+    use tx = conn.BeginTransaction()
+    use tempTx = tempConn.BeginTransaction()
 
-  try
-    Store.Init.initStore conn
-    Store.Init.initStore tempConn
+    try
+      Store.Init.initStore conn
+      Store.Init.initStore tempConn
 
-    let vs = shouldMigrate p conn
-    let xs = migrateDb p tempConn
-    tx.Commit()
+      let vs = shouldMigrate p conn
+      let xs = migrateDb p tempConn
+      tx.Commit()
 
-    match xs with
-    | [] -> nothingToMigrate vs
-    | steps ->
-      if not vs.shouldMigrate then
-        Print.printYellow $"Have in mind since the project and database versions ({vs.projectVersion}) are the same,"
-        Print.printYellow "the steps won't be executed. If you want to execute them,"
-        Print.printYellow "please increase the project version in the file db.toml."
-        Print.printYellow "Otherwise you can use the command `mig commit -a` to amend the last migration"
-        printfn ""
-
-      Store.Print.printMigrationIntent steps
-  with e ->
-    tx.Rollback()
-    Print.printRed e.Message
+      match xs with
+      | [] -> nothingToMigrate vs
+      | steps ->
+        if not vs.shouldMigrate then
+          Print.printYellow $"Have in mind since the project and database versions ({vs.projectVersion}) are the same,"
+          Print.printYellow "the steps won't be executed. If you want to execute them,"
+          Print.printYellow "please increase the project version in the file db.toml."
+          Print.printYellow "Otherwise you can use the command `mig commit -a` to amend the last migration"
+          printfn ""
+
+        Store.Print.printMigrationIntent steps
+    with e ->
+      tx.Rollback()
+      Print.printRed e.Message)
@@ -19,7 +19,10 @@ let amendLastMigration (conn: SqliteConnection) (m: MigrationLog) (xs: ProposalR
     |> List.map (fun s ->
       { reason = s.reason
         error = s.error
-        statements = [ s.sql ] })
+        statements = [ s.sql ]
+        rebuilds = None
+        warning = None
+        destructive = false })
 
   let intent =
     { versionRemarks = m.migration.versionRemarks
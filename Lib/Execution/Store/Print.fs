@@ -58,6 +58,10 @@ let printMigrationIntent (steps: ProposalResult list) =
   |> List.iteri (fun i step ->
     printGreen $"step {i}"
     printYellowIntro $"reason" $"{step.reason}"
+    step.warning |> Option.iter (printYellowIntro "warning")
 
     let sql = step.statements |> Migrate.DbUtil.joinSqlPretty
     formatStep i sql step.error)
+
+let printWarnings (steps: ProposalResult list) =
+  steps |> List.choose _.warning |> List.iter (printYellowIntro "warning")
@@ -14,26 +14,56 @@
 
 module internal Migrate.SqlGeneration.Column
 
+open System.Text.RegularExpressions
 open Migrate.Types
 open Migrate.SqlParser
+open Migrate.SqlGeneration.Util
 open Migrate.SqlGeneration.Table
 
 let sqlAddColumn (table: string) (c: ColumnDef) =
   c.constraints
   |> List.exists (function
-    | Default _ -> true
+    | Default _
+    | DefaultExpr _
+    | Generated(_, Virtual) -> true
     | _ -> false)
   |> function
     | false -> NoDefaultValueForColumn $"{table}.{c.name}" |> raise
     | _ -> ()
 
-  [ $"ALTER TABLE {table} ADD COLUMN {sqlColumnDef c}" ]
+  [ $"ALTER TABLE {quoteIdent table} ADD COLUMN {sqlColumnDef c}" ]
 
 let sqlDropColumn (table: string) (c: ColumnDef) =
-  [ $"ALTER TABLE {table} DROP COLUMN {c.name}" ]
+  [ $"ALTER TABLE {quoteIdent table} DROP COLUMN {quoteIdent c.name}" ]
 
-let sqlUpdateColumn (views: CreateView list) (table: CreateTable) (left: ColumnDef) (right: ColumnDef) =
-  if left.constraints <> right.constraints then
-    sqlRecreateTable views table |> Some
-  else
-    None
+let sqlRenameColumn (table: string) (c: ColumnDef) (n: ColumnDef) =
+  [ $"ALTER TABLE {quoteIdent table} RENAME COLUMN {quoteIdent c.name} TO {quoteIdent n.name}" ]
+
+/// <summary>
+/// Whether right changes the definition of left in a way only a rebuild of their table applies
+/// </summary>
+let changesDefinition (left: ColumnDef) (right: ColumnDef) =
+  // type names are case insensitive, but a changed length or precision like VARCHAR(100) to
+  // VARCHAR(255) is kept by rebuilding the table
+  let sameType =
+    System.String.Equals(sqlColumnType left, sqlColumnType right, System.StringComparison.OrdinalIgnoreCase)
+
+  left.constraints <> right.constraints || not sameType
+
+/// <summary>
+/// Expression converting the values of column, with the source affinity, to the target one
+/// </summary>
+let sqlConvert (source: SqlType) (target: SqlType) (column: string) =
+  match source, target with
+  | s, t when s = t -> column
+  // values keep their storage class in a column with BLOB affinity
+  | _, SqlBlob -> column
+  // CAST truncates reals, they're rounded to the nearest integer instead
+  | SqlReal, SqlInteger -> $"CAST(ROUND({column}) AS INTEGER)"
+  | _, SqlInteger -> $"CAST({column} AS INTEGER)"
+  | _, SqlReal -> $"CAST({column} AS REAL)"
+  | _, SqlText -> $"CAST({column} AS TEXT)"
+  | _, SqlNumeric _ -> $"CAST({column} AS NUMERIC)"
+
+let isRenameColumn (sql: string) =
+  Regex.IsMatch(sql, @"^ALTER TABLE .+ RENAME COLUMN ")
@@ -14,10 +14,20 @@
 
 module internal Migrate.SqlGeneration.Index
 
+open System.Text.RegularExpressions
 open Migrate.Types
 
+let sqlWhere (index: CreateIndex) =
+  index.where |> Option.map (fun w -> $" WHERE {w}") |> Option.defaultValue ""
+
 let sqlCreateIndex (index: CreateIndex) =
-  let cols = index.columns |> Util.sepComma id
-  [ $"CREATE INDEX {index.name} ON {index.table}({cols})" ]
+  // columns are indexed expressions with their collation and sort order, kept as written in the source.
+  // Bare names are quoted like other identifiers
+  let column (c: string) =
+    if Regex.IsMatch(c, @"^\w+$") then Util.quoteIdent c else c
+
+  let cols = index.columns |> Util.sepComma column
+  let unique = if index.unique then "UNIQUE " else ""
+  [ $"CREATE {unique}INDEX {Util.quoteIdent index.name} ON {Util.quoteIdent index.table}({cols}){sqlWhere index}" ]
 
-let sqlDropIndex (index: CreateIndex) = [ $"DROP INDEX {index.name}" ]
+let sqlDropIndex (index: CreateIndex) = [ $"DROP INDEX {Util.quoteIdent index.name}" ]
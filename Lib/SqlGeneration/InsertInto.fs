@@ -19,13 +19,15 @@ open Migrate.Types
 let sqlLiteral (e: Expr) =
   match e with
   | Integer c -> $"{c}"
+  | Real c -> Util.sqlReal c
+  | Blob c -> Util.sqlBlob c
   | String s -> $"'{s}'"
 
 let sqlRowToString (vs: Expr list) =
   vs |> List.map sqlLiteral |> String.concat ", " |> (fun v -> $"({v})")
 
 let sqlColumnNames (i: InsertInto) =
-  i.columns |> String.concat ", " |> (fun c -> $"({c})")
+  i.columns |> Util.sepComma Util.quoteIdent |> (fun c -> $"({c})")
 
 let sqlInsertInto (i: InsertInto) =
   match i.values with
@@ -33,4 +35,4 @@ let sqlInsertInto (i: InsertInto) =
   | _ ->
     let columns = sqlColumnNames i
     let values = i.values |> List.map sqlRowToString |> String.concat ",\n"
-    [ $"INSERT INTO {i.table}{columns} VALUES\n{values}" ]
+    [ $"INSERT INTO {Util.quoteIdent i.table}{columns} VALUES\n{values}" ]
@@ -20,14 +20,16 @@ open Util
 let sqlExpr =
   function
   | Integer v -> string v
+  | Real v -> sqlReal v
+  | Blob v -> sqlBlob v
   | String v -> $"'{v}'"
 
 let rowToSetEqual (colValues: (string * Expr) list) =
-  colValues |> sepComma (fun (c, v) -> $"{c} = {sqlExpr v}")
+  colValues |> sepComma (fun (c, v) -> $"{quoteIdent c} = {sqlExpr v}")
 
 let rowToPred (colValues: (string * Expr) list) =
   colValues
-  |> List.map (fun (c, v) -> $"{c} = {sqlExpr v}")
+  |> List.map (fun (c, v) -> $"{quoteIdent c} = {sqlExpr v}")
   |> String.concat " AND "
 
 let sqlUpdateRow (ins: InsertInto) (keyIndexes: int list) (row: Expr list) =
@@ -39,14 +41,14 @@ let sqlUpdateRow (ins: InsertInto) (keyIndexes: int list) (row: Expr list) =
   let nonKeyCols = nonKeyIndexes |> List.map (fun i -> ins.columns[i], row[i])
   let set = rowToSetEqual nonKeyCols
   let rowMatch = rowToPred keyCols
-  [ $"UPDATE {ins.table} SET {set} WHERE {rowMatch}" ]
+  [ $"UPDATE {quoteIdent ins.table} SET {set} WHERE {rowMatch}" ]
 
 let sqlDeleteRow (ins: InsertInto) (keyIndexes: int list) (row: Expr list) =
   let keyCols = keyIndexes |> List.map (fun i -> ins.columns[i], row[i]) |> rowToPred
-  [ $"DELETE FROM {ins.table} WHERE {keyCols}" ]
+  [ $"DELETE FROM {quoteIdent ins.table} WHERE {keyCols}" ]
 
 let sqlInsertRow (i: InsertInto) (row: Expr list) =
   assert (i.columns.Length = row.Length)
   let values = row |> sepComma sqlExpr
-  let cols = i.columns |> sepComma id
-  [ $"INSERT INTO {i.table}({cols}) VALUES ({values})" ]
+  let cols = i.columns |> sepComma quoteIdent
+  [ $"INSERT INTO {quoteIdent i.table}({cols}) VALUES ({values})" ]
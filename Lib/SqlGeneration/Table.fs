@@ -17,57 +17,202 @@ module internal Migrate.SqlGeneration.Table
 open Migrate.Types
 open Migrate.SqlGeneration.Util
 
+let sqlForeignKeyAction =
+  function
+  | Cascade -> "CASCADE"
+  | SetNull -> "SET NULL"
+  | SetDefault -> "SET DEFAULT"
+  | Restrict -> "RESTRICT"
+  | NoAction -> "NO ACTION"
+
+let sqlDefault =
+  function
+  | String v -> $"'{v}'"
+  | Integer v -> $"{v}"
+  | Real v -> sqlReal v
+  | Blob v -> sqlBlob v
+
 let sqlConstraint =
   function
   | NotNull -> "NOT NULL"
   | PrimaryKey [] -> "PRIMARY KEY"
-  | PrimaryKey xs -> $"PRIMARY KEY({sepComma id xs})"
+  | PrimaryKey xs -> $"PRIMARY KEY({sepComma quoteIdent xs})"
   | Autoincrement -> "AUTOINCREMENT"
-  | Default(String v) -> $"DEFAULT '{v}'"
-  | Default(Integer v) -> $"DEFAULT {v}"
+  | Default v -> $"DEFAULT {sqlDefault v}"
+  | DefaultExpr e -> $"DEFAULT {e}"
   | Unique [] -> "UNIQUE"
-  | Unique xs -> $"UNIQUE({sepComma id xs})"
+  | Unique xs -> $"UNIQUE({sepComma quoteIdent xs})"
+  | Check e -> $"CHECK({e})"
+  | Generated(e, Stored) -> $"GENERATED ALWAYS AS ({e}) STORED"
+  | Generated(e, Virtual) -> $"GENERATED ALWAYS AS ({e}) VIRTUAL"
+  | Collate c -> $"COLLATE {c}"
   | ForeignKey f ->
-    let cols = f.columns |> sepComma id
-    let refCols = f.refColumns |> sepComma id
-    $"FOREIGN KEY({cols}) REFERENCES {f.refTable}({refCols})"
+    let actions =
+      [ f.onDelete |> Option.map (fun a -> $" ON DELETE {sqlForeignKeyAction a}")
+        f.onUpdate |> Option.map (fun a -> $" ON UPDATE {sqlForeignKeyAction a}")
+        (if f.deferred then Some " DEFERRABLE INITIALLY DEFERRED" else None) ]
+      |> List.choose id
+      |> String.concat ""
+
+    let references =
+      match f.refColumns with
+      | [] -> $"REFERENCES {quoteIdent f.refTable}{actions}"
+      | xs -> $"REFERENCES {quoteIdent f.refTable}({sepComma quoteIdent xs}){actions}"
+
+    match f.columns with
+    | [] -> references
+    | xs -> $"FOREIGN KEY({sepComma quoteIdent xs}) {references}"
 
 let sqlColType =
   function
   | SqlInteger -> "integer"
   | SqlText -> "text"
+  | SqlReal -> "real"
+  | SqlBlob -> "blob"
+  | SqlNumeric t -> t
+
+/// <summary>
+/// Type of column c as it was declared, or the name of its storage class when it wasn't
+/// </summary>
+let sqlColumnType (c: ColumnDef) =
+  c.declaredType |> Option.defaultWith (fun () -> sqlColType c.columnType)
+
+let isGenerated (c: ColumnDef) =
+  c.constraints
+  |> List.exists (function
+    | Generated _ -> true
+    | _ -> false)
 
 let sqlColumnDef (c: ColumnDef) =
   let constraints = c.constraints |> List.map sqlConstraint |> String.concat " "
-  $"{c.name} {c.columnType |> sqlColType} {constraints}"
+  $"{quoteIdent c.name} {sqlColumnType c} {constraints}"
+
+/// <summary>
+/// Value a new row gets for column c when the insert leaves it out, NULL without a default
+/// </summary>
+let sqlDefaultValue (c: ColumnDef) =
+  c.constraints
+  |> List.tryPick (function
+    | Default v -> Some(sqlDefault v)
+    | DefaultExpr e -> Some e
+    | _ -> None)
+  |> Option.defaultValue "NULL"
 
 let sqlTableConstraints (table: CreateTable) =
   match table.constraints with
   | [] -> ""
   | _ -> $", {table.constraints |> sepComma sqlConstraint}"
 
-let sqlDropTable (table: CreateTable) = [ $"DROP TABLE {table.name}" ]
+let sqlTableOptions (table: CreateTable) =
+  let options =
+    [ if table.withoutRowid then
+        "WITHOUT ROWID"
+      if table.strict then
+        "STRICT" ]
+
+  match options with
+  | [] -> ""
+  | options -> " " + String.concat ", " options
+
+let sqlDropTable (table: CreateTable) = [ $"DROP TABLE {quoteIdent table.name}" ]
+
+// lines separated by commas, with a comment after the comma of the lines having one,
+// since a line comment ends at the end of its line
+let sepCommaNlCommented (lines: (string * string option) list) =
+  let last = List.length lines - 1
+
+  lines
+  |> List.mapi (fun i (line, comment) ->
+    let sep = if i < last then "," else ""
+
+    match comment with
+    | Some c -> $"{line}{sep} -- {c}"
+    | None -> line + sep)
+  |> String.concat "\n"
 
 let sqlCreateTable (table: CreateTable) =
   let columns = table.columns |> sepComma sqlColumnDef
   let constraints = sqlTableConstraints table
-  [ $"CREATE TABLE {table.name}({columns}{constraints})" ]
+  let temp = if table.temporary then "TEMP " else ""
+
+  if table.columnComments.IsEmpty then
+    [ $"CREATE {temp}TABLE {quoteIdent table.name}({columns}{constraints}){sqlTableOptions table}" ]
+  else
+    // every commented column needs a line of its own
+    let lines =
+      (table.columns
+       |> List.map (fun c -> $"  {(sqlColumnDef c).TrimEnd()}", table.columnComments.TryFind c.name))
+      @ (table.constraints |> List.map (fun c -> $"  {sqlConstraint c}", None))
+
+    [ $"CREATE {temp}TABLE {quoteIdent table.name}(\n{sepCommaNlCommented lines}\n){sqlTableOptions table}" ]
+
+/// <summary>
+/// CREATE TABLE statement with a line for every column and table constraint, aligning
+/// column types and constraints, for schemas meant to be read and reviewed
+/// </summary>
+let sqlCreateTableFormatted (table: CreateTable) =
+  let width (f: ColumnDef -> string) =
+    table.columns |> List.map (f >> String.length) |> List.fold max 0
+
+  let name (c: ColumnDef) = quoteIdent c.name
+  let colType (c: ColumnDef) = sqlColumnType c
+  let nameWidth, typeWidth = width name, width colType
+
+  let column (c: ColumnDef) =
+    let constraints = c.constraints |> List.map sqlConstraint |> String.concat " "
+    $"{(name c).PadRight nameWidth} {(colType c).PadRight typeWidth} {constraints}".TrimEnd()
+
+  let lines =
+    (table.columns
+     |> List.map (fun c -> "  " + column c, table.columnComments.TryFind c.name))
+    @ (table.constraints |> List.map (fun c -> "  " + sqlConstraint c, None))
+
+  let temp = if table.temporary then "TEMP " else ""
+  $"CREATE {temp}TABLE {quoteIdent table.name}(\n{sepCommaNlCommented lines}\n){sqlTableOptions table}"
 
 let sqlRenameTable (c: CreateTable) (n: CreateTable) =
-  [ $"ALTER TABLE {c.name} RENAME TO {n.name}" ]
+  [ $"ALTER TABLE {quoteIdent c.name} RENAME TO {quoteIdent n.name}" ]
+
+let sqlCreateVirtualTable (table: CreateVirtualTable) =
+  [ $"CREATE VIRTUAL TABLE {quoteIdent table.name} USING {table.moduleName}({sepComma id table.moduleArgs})" ]
+
+let sqlDropVirtualTable (table: CreateVirtualTable) = [ $"DROP TABLE {quoteIdent table.name}" ]
 
 let dropDependentViews (views: CreateView list) (table: string) = []
 
-let sqlRecreateTable (views: CreateView list) (table: CreateTable) =
+/// <summary>
+/// Rebuilds table with its new definition, filling every column with the expression
+/// selectColumn returns for it from the rows of the old table, copied with the insert statement
+/// </summary>
+let sqlRecreateTableInserting
+  (insert: string)
+  (views: CreateView list)
+  (table: CreateTable)
+  (selectColumn: ColumnDef -> string)
+  =
   let auxTable =
     { table with
         name = $"{table.name}_aux" }
 
   let createAux = auxTable |> sqlCreateTable
-  let auxColumns = auxTable.columns |> sepComma (fun c -> c.name)
+  // generated columns are computed by the new table, they can't be inserted
+  let copied = auxTable.columns |> List.filter (isGenerated >> not)
+  let auxColumns = copied |> sepComma (fun c -> quoteIdent c.name)
+  let selected = copied |> sepComma selectColumn
+  let auxName = quoteIdent auxTable.name
+  let name = quoteIdent table.name
 
   dropDependentViews views table.name
   @ createAux
-  @ [ $"INSERT OR IGNORE INTO {auxTable.name}({auxColumns}) SELECT {auxColumns} FROM {table.name}"
-      $"DROP TABLE {table.name}"
-      $"ALTER TABLE {auxTable.name} RENAME TO {table.name}" ]
+  @ [ $"{insert} {auxName}({auxColumns}) SELECT {selected} FROM {name}"
+      $"DROP TABLE {name}"
+      $"ALTER TABLE {auxName} RENAME TO {name}" ]
+
+/// <summary>
+/// Like sqlRecreateTableInserting, ignoring the rows breaking the constraints of the new table
+/// </summary>
+let sqlRecreateTableWith (views: CreateView list) (table: CreateTable) (selectColumn: ColumnDef -> string) =
+  sqlRecreateTableInserting "INSERT OR IGNORE INTO" views table selectColumn
+
+let sqlRecreateTable (views: CreateView list) (table: CreateTable) =
+  sqlRecreateTableWith views table (fun c -> quoteIdent c.name)
@@ -14,7 +14,70 @@
 
 module internal Migrate.SqlGeneration.Util
 
+open System.Text.RegularExpressions
+
 
 let sepComma (f: 'a -> string) (xs: 'a list) = xs |> List.map f |> String.concat ", "
 
 let sepCommaNl (f: 'a -> string) (xs: 'a list) = xs |> List.map f |> String.concat ",\n"
+
+/// <summary>
+/// Blob literal, with its bytes in hexadecimal
+/// </summary>
+let sqlBlob (v: byte array) =
+  $"X'{System.Convert.ToHexString v}'"
+
+/// <summary>
+/// Real number keeping its decimal point, so it isn't read back as an integer
+/// </summary>
+let sqlReal (v: float) =
+  let s = v.ToString("R", System.Globalization.CultureInfo.InvariantCulture)
+
+  if s |> String.exists (fun c -> c = '.' || c = 'E') then s else $"{s}.0"
+
+let sqliteKeywords =
+  set
+    [ "ABORT"; "ACTION"; "ADD"; "AFTER"; "ALL"; "ALTER"; "ALWAYS"; "ANALYZE"; "AND"; "AS"; "ASC"
+      "ATTACH"; "AUTOINCREMENT"; "BEFORE"; "BEGIN"; "BETWEEN"; "BY"; "CASCADE"; "CASE"; "CAST"
+      "CHECK"; "COLLATE"; "COLUMN"; "COMMIT"; "CONFLICT"; "CONSTRAINT"; "CREATE"; "CROSS"
+      "CURRENT"; "CURRENT_DATE"; "CURRENT_TIME"; "CURRENT_TIMESTAMP"; "DATABASE"; "DEFAULT"
+      "DEFERRABLE"; "DEFERRED"; "DELETE"; "DESC"; "DETACH"; "DISTINCT"; "DO"; "DROP"; "EACH"
+      "ELSE"; "END"; "ESCAPE"; "EXCEPT"; "EXCLUDE"; "EXCLUSIVE"; "EXISTS"; "EXPLAIN"; "FAIL"
+      "FILTER"; "FIRST"; "FOLLOWING"; "FOR"; "FOREIGN"; "FROM"; "FULL"; "GENERATED"; "GLOB"
+      "GROUP"; "GROUPS"; "HAVING"; "IF"; "IGNORE"; "IMMEDIATE"; "IN"; "INDEX"; "INDEXED"
+      "INITIALLY"; "INNER"; "INSERT"; "INSTEAD"; "INTERSECT"; "INTO"; "IS"; "ISNULL"; "JOIN"
+      "KEY"; "LAST"; "LEFT"; "LIKE"; "LIMIT"; "MATCH"; "MATERIALIZED"; "NATURAL"; "NO"; "NOT"
+      "NOTHING"; "NOTNULL"; "NULL"; "NULLS"; "OF"; "OFFSET"; "ON"; "OR"; "ORDER"; "OTHERS"
+      "OUTER"; "OVER"; "PARTITION"; "PLAN"; "PRAGMA"; "PRECEDING"; "PRIMARY"; "QUERY"; "RAISE"
+      "RANGE"; "RECURSIVE"; "REFERENCES"; "REGEXP"; "REINDEX"; "RELEASE"; "RENAME"; "REPLACE"
+      "RESTRICT"; "RETURNING"; "RIGHT"; "ROLLBACK"; "ROW"; "ROWS"; "SAVEPOINT"; "SELECT"; "SET"
+      "TABLE"; "TEMP"; "TEMPORARY"; "THEN"; "TIES"; "TO"; "TRANSACTION"; "TRIGGER"; "UNBOUNDED"
+      "UNION"; "UNIQUE"; "UPDATE"; "USING"; "VACUUM"; "VALUES"; "VIEW"; "VIRTUAL"; "WHEN"; "WHERE"
+      "WINDOW"; "WITH"; "WITHOUT" ]
+
+/// <summary>
+/// The identifier as is when it's a valid SQL name, otherwise between double quotes
+/// </summary>
+let quoteIdent (name: string) =
+  if Regex.IsMatch(name, @"^[A-Za-z_]\w*$") && not (sqliteKeywords.Contains(name.ToUpperInvariant())) then
+    name
+  else
+    "\"" + name.Replace("\"", "\"\"") + "\""
+
+let sqlIfNotExists (sql: string) =
+  Regex.Replace(sql, @"^CREATE ((?:TEMP )?(?:TABLE|VIEW)|VIRTUAL TABLE|UNIQUE INDEX|INDEX) ", "CREATE $1 IF NOT EXISTS ")
+
+/// <summary>
+/// sql with its double quoted identifiers between backticks, leaving strings and comments as they are
+/// </summary>
+let sqlBackticks (sql: string) =
+  let backticks (t: Migrate.SqlText.Token) =
+    if t.text.StartsWith "\"" then
+      "`" + (Migrate.SqlText.unquote t).Replace("`", "``") + "`"
+    else
+      t.text
+
+  // replacing from the last token keeps the positions of the ones before it
+  Migrate.SqlText.tokens sql
+  |> List.rev
+  |> List.fold (fun (acc: string) t -> acc.Remove(t.index, t.text.Length).Insert(t.index, backticks t)) sql
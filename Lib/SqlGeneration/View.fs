@@ -17,7 +17,12 @@ module internal Migrate.SqlGeneration.View
 open Migrate.Types
 
 let sqlCreateView (view: CreateView) =
+  let columns =
+    match view.columns with
+    | [] -> ""
+    | xs -> $"({Util.sepComma Util.quoteIdent xs})"
 
-  [ $"CREATE VIEW {view.name} AS\n{view.selectUnion}" ]
+  let temp = if view.temporary then "TEMP " else ""
+  [ $"CREATE {temp}VIEW {Util.quoteIdent view.name}{columns} AS\n{view.selectUnion}" ]
 
-let sqlDropView (view: CreateView) = [ $"DROP VIEW {view.name}" ]
+let sqlDropView (view: CreateView) = [ $"DROP VIEW {Util.quoteIdent view.name}" ]
@@ -7,6 +7,73 @@ open Migrate.Types
 open SqlParser.Dialects
 open SqlParser.Tokens
 
+let literalExpr (e: Expression) =
+  match box e with
+  | :? Expression.LiteralValue as l ->
+    match box l.Value with
+    | :? Value.SingleQuotedString as s -> s.Value |> String
+    | :? Value.Number as n ->
+      match System.Int32.TryParse n.Value with
+      | true, i -> Integer i
+      | _ -> System.Double.Parse(n.Value, System.Globalization.CultureInfo.InvariantCulture) |> Real
+    | :? Value.HexStringLiteral as h -> System.Convert.FromHexString h.Value |> Blob
+    | v -> failwith $"unsupported literal {v}"
+  | v -> failwith $"value {v} not supported, expecting a literal"
+
+// defaults other than literals, like CURRENT_TIMESTAMP, negative numbers or expressions between
+// parentheses, are kept as written
+let defaultValue (e: Expression) =
+  match box e with
+  | :? Expression.LiteralValue as l ->
+    match box l.Value with
+    | :? Value.SingleQuotedString
+    | :? Value.Number
+    | :? Value.HexStringLiteral -> literalExpr e |> Default
+    | _ -> e.ToSql() |> DefaultExpr
+  | _ -> e.ToSql() |> DefaultExpr
+
+let foreignKeyAction (a: Ast.ReferentialAction) =
+  match a with
+  | Ast.ReferentialAction.Cascade -> Some Cascade
+  | Ast.ReferentialAction.SetNull -> Some SetNull
+  | Ast.ReferentialAction.SetDefault -> Some SetDefault
+  | Ast.ReferentialAction.Restrict -> Some Restrict
+  | Ast.ReferentialAction.NoAction -> Some NoAction
+  | _ -> None
+
+// constraints declared NOT DEFERRABLE or INITIALLY IMMEDIATE are checked after each statement,
+// like the ones without characteristics
+let deferredCheck (c: ConstraintCharacteristics) =
+  match Option.ofObj c with
+  | Some c ->
+    Option.ofNullable c.Deferrable = Some true
+    && Option.ofNullable c.Initially = Some DeferrableInitial.Deferred
+  | None -> false
+
+/// <summary>
+/// Storage type for a declared column type, following SQLite's type affinity rules.
+/// Columns without a declared type have BLOB affinity
+/// </summary>
+let typeAffinity (declared: string) =
+  let t = declared.Trim().ToUpperInvariant()
+  let containsAny = List.exists (fun (x: string) -> t.Contains x)
+
+  if t.Contains "INT" then SqlInteger
+  elif containsAny [ "CHAR"; "CLOB"; "TEXT" ] then SqlText
+  elif t.Contains "BLOB" || t = "" then SqlBlob
+  elif containsAny [ "REAL"; "FLOA"; "DOUB" ] then SqlReal
+  else declared.Trim() |> SqlNumeric
+
+/// <summary>
+/// Name of an object in the main database, qualified or not. Objects qualified with another schema
+/// belong to attached databases, which aren't part of the project
+/// </summary>
+let objectName (n: ObjectName) =
+  match n.Values |> Seq.map _.Value |> Seq.toList with
+  | [ schema; name ] when System.String.Equals(schema, "main", System.StringComparison.OrdinalIgnoreCase) -> name
+  | [ name ] -> name
+  | _ -> AttachedSchemaObject(n.ToSql()) |> raise
+
 let classifyStatement (acc: SqlFile) (s: Statement) =
   match box s with
   | :? Statement.Insert as s ->
@@ -15,21 +82,11 @@ let classifyStatement (acc: SqlFile) (s: Statement) =
     let vss =
       s.Source.Query.Body :?> SetExpression.ValuesExpression
       |> _.Values.Rows
-      |> Seq.map (fun r ->
-        r
-        |> Seq.map (fun e ->
-          match box e with
-          | :? Expression.LiteralValue as l ->
-            match box l.Value with
-            | :? Value.SingleQuotedString as s -> s.Value |> String
-            | :? Value.Number as n -> n.Value |> int |> Integer
-            | v -> failwith $"unsupported literal {v}"
-          | v -> failwith $"value {v} not supported in insert")
-        |> Seq.toList)
+      |> Seq.map (fun r -> r |> Seq.map literalExpr |> Seq.toList)
       |> Seq.toList
 
     let ins =
-      { table = s.Name.Values |> Seq.head |> _.Value
+      { table = objectName s.Name
         columns = cols
         values = vss }
 
@@ -43,7 +100,8 @@ let classifyStatement (acc: SqlFile) (s: Statement) =
           match box c.DataType with
           | :? DataType.Integer -> SqlInteger
           | :? DataType.Text -> SqlText
-          | _ -> failwith $"unsupported type {c.DataType}"
+          | :? DataType.Blob -> SqlBlob
+          | _ -> c.DataType.ToSql() |> typeAffinity
 
         let cs =
           c.Options
@@ -52,19 +110,41 @@ let classifyStatement (acc: SqlFile) (s: Statement) =
             | :? ColumnOption.Unique as u when u.IsPrimary -> PrimaryKey [] |> Some
             | :? ColumnOption.Unique -> Unique [] |> Some
             | :? ColumnOption.NotNull -> NotNull |> Some
-            | :? ColumnOption.Default as d ->
-              d.Expression.AsLiteral().Value.AsSingleQuoted().Value
-              |> String
-              |> Default
+            | :? ColumnOption.Default as d -> defaultValue d.Expression |> Some
+            | :? ColumnOption.Check as c -> c.Expression.ToSql() |> Check |> Some
+            | :? ColumnOption.Generated as g when g.GenerationExpr <> null ->
+              // SQLite stores generated columns as VIRTUAL unless declared STORED
+              let storage =
+                match Option.ofNullable g.GenerationExpressionMode with
+                | Some GeneratedExpression.Stored -> Stored
+                | _ -> Virtual
+
+              Generated(g.GenerationExpr.ToSql(), storage) |> Some
+            | :? ColumnOption.ForeignKey as fk ->
+              { columns = []
+                refTable = objectName fk.ForeignTable
+                refColumns =
+                  fk.ReferredColumns
+                  |> Option.ofObj
+                  |> Option.map (Seq.map _.Value >> Seq.toList)
+                  |> Option.defaultValue []
+                onDelete = foreignKeyAction fk.OnDelete
+                onUpdate = foreignKeyAction fk.OnUpdate
+                deferred = deferredCheck fk.Characteristics }
+              |> ForeignKey
               |> Some
             | :? ColumnOption.DialectSpecific as d when d.Tokens.Contains(Word("AUTOINCREMENT")) ->
               Autoincrement |> Some
             | _ -> None)
           |> Seq.toList
 
+        let collate =
+          c.Collation |> Option.ofObj |> Option.map (fun n -> n.ToSql() |> Collate) |> Option.toList
+
         { name = c.Name.Value
           columnType = t
-          constraints = cs })
+          declaredType = None
+          constraints = collate @ cs })
       |> Seq.toList
 
     let empty = Sequence<TableConstraint>()
@@ -82,55 +162,217 @@ let classifyStatement (acc: SqlFile) (s: Statement) =
         | :? TableConstraint.Unique as d ->
           let cols = d.Columns |> Seq.map _.Value |> Seq.toList
           Unique cols |> Some
+        | :? TableConstraint.Check as c -> c.Expression.ToSql() |> Check |> Some
         | :? TableConstraint.ForeignKey as fk ->
 
           let fk =
             { columns = fk.Columns |> Seq.map (fun c -> c.Value) |> Seq.toList
-              refTable = fk.ForeignTable.Values |> Seq.head |> _.Value
-              refColumns = fk.ReferredColumns |> Seq.map _.Value |> Seq.toList }
+              refTable = objectName fk.ForeignTable
+              refColumns = fk.ReferredColumns |> Seq.map _.Value |> Seq.toList
+              onDelete = foreignKeyAction fk.OnDelete
+              onUpdate = foreignKeyAction fk.OnUpdate
+              deferred = deferredCheck fk.Characteristics }
 
           ForeignKey fk |> Some
         | _ -> None)
       |> Seq.toList
 
     let ct =
-      { name = s.Name.Values |> Seq.head |> _.Value
+      { name = objectName s.Name
         columns = cols
-        constraints = constraints }
+        constraints = constraints
+        renamedColumns = Map.empty
+        annotations = Map.empty
+        columnComments = Map.empty
+        withoutRowid = s.WithoutRowId
+        strict = s.Strict
+        temporary = s.Temporary }
+
+    // SQLite rejects WITHOUT ROWID tables without a PRIMARY KEY
+    let hasPrimaryKey =
+      ct.constraints @ (ct.columns |> List.collect _.constraints)
+      |> List.exists (function
+        | PrimaryKey _ -> true
+        | _ -> false)
+
+    if ct.withoutRowid && not hasPrimaryKey then
+      TableShouldHavePrimaryKey ct.name |> raise
 
     { acc with tables = ct :: acc.tables }
   | :? Statement.CreateView as s ->
     let cv =
-      { name = s.Name.Values |> Seq.head |> _.Value
-        selectUnion = s.Query.ToSql() }
+      { name = objectName s.Name
+        selectUnion = s.Query.ToSql()
+        columns =
+          s.Columns
+          |> Option.ofObj
+          |> Option.map (Seq.map (fun c -> c.ToSql().Trim '"') >> Seq.toList)
+          |> Option.defaultValue []
+        temporary = s.Temporary }
 
     { acc with views = cv :: acc.views }
+  | :? Statement.CreateVirtualTable as s ->
+    let vt =
+      { name = objectName s.Name
+        moduleName = s.ModuleName.Value
+        moduleArgs =
+          s.ModuleArgs
+          |> Option.ofObj
+          |> Option.map (Seq.map _.ToSql() >> Seq.toList)
+          |> Option.defaultValue [] }
+
+    { acc with
+        virtualTables = vt :: acc.virtualTables }
   | :? Statement.CreateIndex as s ->
-    let name = s.Name.Values |> Seq.head |> _.Value
-    let table = s.TableName.Values |> Seq.head |> _.Value
+    let name = objectName s.Name
+    let table = objectName s.TableName
 
-    let columns =
-      s.Columns |> Seq.map (_.Expression.AsIdentifier().Ident.Value) |> Seq.toList
+    // each column keeps its expression, collation and sort order
+    let columns = s.Columns |> Seq.map _.ToSql() |> Seq.toList
 
     let index =
       { name = name
         table = table
-        columns = columns }
+        columns = columns
+        where = s.Predicate |> Option.ofObj |> Option.map _.ToSql()
+        unique = s.Unique }
 
     { acc with
         indexes = index :: acc.indexes }
   | _ -> acc
 
+// CREATE TABLE statements in sql, with the column definitions and constraints in their bodies
+let private createdTables (sql: string) =
+  sql
+  |> SqlText.tokens
+  |> SqlText.statements
+  |> List.choose (fun s -> SqlText.createdTable s |> Option.map (fun table -> table, SqlText.tableDefinitions s))
+
+/// <summary>
+/// Maps every table to its columns declared right after a `-- @renamed-from old_name` comment,
+/// each one mapped to old_name
+/// </summary>
+let renamedColumns (sql: string) =
+  createdTables sql
+  |> List.map (fun (table, definitions) ->
+    let columns =
+      definitions
+      |> List.choose (fun d ->
+        d.leading
+        |> List.tryPick (SqlText.annotation "renamed-from")
+        |> Option.map (fun from -> SqlText.unquote d.tokens.Head, from))
+      |> Map.ofList
+
+    table, columns)
+  |> Map.ofList
+
+/// <summary>
+/// Maps every table to its definitions followed by a `-- comment` on the line where they end,
+/// each one mapped to the comment. Table constraints are included, with their first word as name
+/// </summary>
+let columnComments (sql: string) =
+  createdTables sql
+  |> List.map (fun (table, definitions) ->
+    let columns =
+      definitions
+      |> List.choose (fun d ->
+        d.trailing
+        |> List.tryPick SqlText.lineComment
+        |> Option.map (fun comment -> SqlText.unquote d.tokens.Head, comment))
+      |> Map.ofList
+
+    table, columns)
+  |> Map.ofList
+
+/// <summary>
+/// Maps every table to the `-- @key value` comments before the statement creating it
+/// </summary>
+let tableAnnotations (sql: string) =
+  sql
+  |> SqlText.tokens
+  |> SqlText.statements
+  |> List.choose (fun s ->
+    SqlText.createdTable s
+    |> Option.map (fun table ->
+      table, s |> List.takeWhile SqlText.isComment |> List.choose SqlText.annotations |> Map.ofList))
+  |> Map.ofList
+
+/// <summary>
+/// Maps every table to its columns, each one mapped to its type as written in sql
+/// </summary>
+let declaredTypes (sql: string) =
+  createdTables sql
+  |> List.map (fun (table, definitions) ->
+    let columns =
+      definitions
+      |> List.map (fun d -> SqlText.unquote d.tokens.Head, SqlText.declaredType sql d)
+      |> Map.ofList
+
+    table, columns)
+  |> Map.ofList
+
+/// <summary>
+/// CREATE TRIGGER statements in sql, with the triggers they create
+/// </summary>
+let private triggerStatements (sql: string) =
+  sql
+  |> SqlText.tokens
+  |> SqlText.statements
+  |> List.choose (fun s ->
+    SqlText.createdTrigger s
+    |> Option.map (fun (name, table) ->
+      s,
+      { name = name
+        table = table
+        sql = SqlText.statementText sql s
+        temporary = SqlText.createsTemporary s }))
+
 let parseSql (file: string) (sql: string) =
   try
-    let ast = Parser().ParseSql(sql, SQLiteDialect())
+    // triggers are kept as the text creating them, which is left out of the parsed SQL
+    let triggers = triggerStatements sql
+    let ast = Parser().ParseSql(SqlText.blankStatements sql (List.map fst triggers), SQLiteDialect())
 
     let emptyFile =
       { tables = []
         indexes = []
         inserts = []
-        views = [] }
+        views = []
+        virtualTables = []
+        triggers = List.map snd triggers }
 
-    ast |> Seq.fold classifyStatement emptyFile |> Ok
-  with :? ParserException as e ->
-    Error $"Error parsing {file}({e.Line},{e.Column}): {e.Message}"
+    let renamedColumns = renamedColumns sql
+    let tableAnnotations = tableAnnotations sql
+    let columnComments = columnComments sql
+    let declaredTypes = declaredTypes sql
+    let parsed = ast |> Seq.fold classifyStatement emptyFile
+
+    let withDeclaredType (table: string) (c: ColumnDef) =
+      { c with
+          declaredType = declaredTypes.TryFind table |> Option.bind (Map.tryFind c.name) }
+
+    { parsed with
+        tables =
+          parsed.tables
+          |> List.map (fun t ->
+            { t with
+                columns = t.columns |> List.map (withDeclaredType t.name)
+                renamedColumns = renamedColumns.TryFind t.name |> Option.defaultValue Map.empty
+                annotations = tableAnnotations.TryFind t.name |> Option.defaultValue Map.empty
+                columnComments =
+                  columnComments.TryFind t.name
+                  |> Option.defaultValue Map.empty
+                  // lines of table constraints start with keywords, not column names
+                  |> Map.filter (fun c _ -> t.columns |> List.exists (fun d -> d.name = c)) }) }
+    |> Ok
+  with
+  | :? ParserException as e -> Error $"Error parsing {file}({e.Line},{e.Column}): {e.Message}"
+  | TableShouldHavePrimaryKey name -> Error $"Error parsing {file}: {name} is WITHOUT ROWID and has no PRIMARY KEY"
+  | AttachedSchemaObject name -> Error $"Error parsing {file}: {name} isn't in the main database"
+  | Failure msg -> Error $"Error parsing {file}: {msg}"
+
+let parseSqlFile (path: string) =
+  try
+    System.IO.File.ReadAllText path |> parseSql path
+  with :? System.IO.IOException as e ->
+    Error $"Error reading {path}: {e.Message}"
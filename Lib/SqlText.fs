@@ -0,0 +1,284 @@
+// Copyright 2023 Luis Ángel Méndez Gort
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+/// <summary>
+/// Reads from the text of SQL statements what the parser drops, like comments.
+/// The text is split into tokens first, so comment markers inside strings or
+/// quoted identifiers aren't taken for comments
+/// </summary>
+module internal Migrate.SqlText
+
+open System
+open System.Text.RegularExpressions
+
+type Token =
+  { text: string
+    line: int
+    index: int }
+
+/// <summary>
+/// Definition in the body of a CREATE TABLE statement, with the comments on the lines before it
+/// </summary>
+type Definition =
+  { tokens: Token list
+    leading: Token list
+    /// comments after the definition on the line where it ends
+    trailing: Token list }
+
+let private tokenRegex =
+  Regex(@"--[^\n]*|/\*[\s\S]*?(?:\*/|$)|'(?:[^']|'')*'?|""(?:[^""]|"""")*""?|`(?:[^`]|``)*`?|\[[^\]]*\]?|[\w$]+|\S")
+
+/// <summary>
+/// Comments, strings, quoted identifiers, words and symbols of sql, with the lines where they start
+/// </summary>
+let tokens (sql: string) =
+  let matches = tokenRegex.Matches sql |> Seq.toList
+
+  let lines =
+    matches
+    |> List.scan
+      (fun (line, from) (m: Match) ->
+        let newLines = sql.Substring(from, m.Index - from) |> Seq.filter ((=) '\n') |> Seq.length
+        line + newLines, m.Index)
+      (1, 0)
+    |> List.tail
+
+  List.map2
+    (fun (m: Match) (line, _) ->
+      { text = m.Value
+        line = line
+        index = m.Index })
+    matches
+    lines
+
+let isComment (t: Token) =
+  t.text.StartsWith "--" || t.text.StartsWith "/*"
+
+let isWord (word: string) (t: Token) =
+  String.Equals(t.text, word, StringComparison.OrdinalIgnoreCase)
+
+/// <summary>
+/// Identifier without its quotes
+/// </summary>
+let unquote (t: Token) =
+  match t.text[0] with
+  | '"' -> t.text.Trim('"').Replace("\"\"", "\"")
+  | '`' -> t.text.Trim('`').Replace("``", "`")
+  | '[' -> t.text.TrimStart('[').TrimEnd(']')
+  | _ -> t.text
+
+/// <summary>
+/// Key and value of a `-- @key value` comment
+/// </summary>
+let annotations (t: Token) =
+  let m = Regex.Match(t.text, @"^--\s*@([\w-]+)\s+(""(?:[^""]|"""")*""|\S+)")
+
+  if m.Success then
+    Some(m.Groups[1].Value, unquote { t with text = m.Groups[2].Value })
+  else
+    None
+
+/// <summary>
+/// Value of a `-- @key value` comment
+/// </summary>
+let annotation (key: string) (t: Token) =
+  annotations t |> Option.filter (fst >> (=) key) |> Option.map snd
+
+/// <summary>
+/// Text of a `-- comment` that isn't an annotation, without its dashes
+/// </summary>
+let lineComment (t: Token) =
+  if t.text.StartsWith "--" && (annotations t).IsNone then
+    match t.text.Substring(2).Trim() with
+    | "" -> None
+    | text -> Some text
+  else
+    None
+
+/// <summary>
+/// Splits ts into statements, each one ending with its semicolon. Comments before a statement
+/// belong to it. The statements in the body of a trigger end with semicolons too, the trigger
+/// ends after the END closing its body
+/// </summary>
+let statements (ts: Token list) =
+  let isTriggerStart (current: Token list) (t: Token) =
+    isWord "TRIGGER" t
+    && current
+       |> List.filter (isComment >> not)
+       |> List.forall (fun c -> isWord "CREATE" c || isWord "TEMP" c || isWord "TEMPORARY" c)
+
+  let current, acc, _, _ =
+    ts
+    |> List.fold
+      (fun (current, acc, trigger, depth) t ->
+        let trigger = trigger || isTriggerStart current t
+
+        let depth =
+          if not trigger then depth
+          elif isWord "BEGIN" t || isWord "CASE" t then depth + 1
+          elif isWord "END" t then depth - 1
+          else depth
+
+        if t.text = ";" && depth = 0 then
+          [], List.rev (t :: current) :: acc, false, 0
+        else
+          t :: current, acc, trigger, depth)
+      ([], [], false, 0)
+
+  List.rev current :: acc
+  |> List.rev
+  |> List.filter (List.exists (isComment >> not))
+
+// text of sql from the first of ts up to the end of the last one
+let private span (sql: string) (ts: Token list) =
+  let first, last = List.head ts, List.last ts
+  sql.Substring(first.index, last.index + last.text.Length - first.index)
+
+/// <summary>
+/// Text of statement in sql, from its first token after the comments before it,
+/// up to its last token before the semicolon
+/// </summary>
+let statementText (sql: string) (statement: Token list) =
+  match statement |> List.filter (isComment >> not) |> List.filter (fun t -> t.text <> ";") with
+  | [] -> ""
+  | ts -> span sql ts
+
+/// <summary>
+/// sql with the text of statements, including their semicolons, replaced by spaces.
+/// Lines and the positions of the remaining text don't change
+/// </summary>
+let blankStatements (sql: string) (statements: Token list list) =
+  let spans =
+    statements
+    |> List.choose (fun s ->
+      match s |> List.filter (isComment >> not) with
+      | [] -> None
+      | ts -> Some((List.head ts).index, (List.last ts).index + (List.last ts).text.Length))
+
+  sql
+  |> String.mapi (fun i c ->
+    if c <> '\n' && spans |> List.exists (fun (first, last) -> first <= i && i < last) then
+      ' '
+    else
+      c)
+
+// name after the IF NOT EXISTS and the main schema starting ts, with the tokens after it
+let private createdName (ts: Token list) =
+  let ts =
+    match ts with
+    | i :: n :: e :: rest when isWord "IF" i && isWord "NOT" n && isWord "EXISTS" e -> rest
+    | _ -> ts
+
+  match ts with
+  | schema :: dot :: n :: rest when dot.text = "." && isWord "main" schema -> Some(unquote n, rest)
+  | n :: rest -> Some(unquote n, rest)
+  | [] -> None
+
+/// <summary>
+/// Whether statement creates a temporary object, with CREATE TEMP or CREATE TEMPORARY
+/// </summary>
+let createsTemporary (statement: Token list) =
+  match statement |> List.filter (isComment >> not) with
+  | create :: temp :: _ -> isWord "CREATE" create && (isWord "TEMP" temp || isWord "TEMPORARY" temp)
+  | _ -> false
+
+// tokens after CREATE and TEMP of a statement creating the kind of object
+let private created (kind: string) (statement: Token list) =
+  match statement |> List.filter (isComment >> not) with
+  | create :: rest when isWord "CREATE" create ->
+    match rest |> List.skipWhile (fun t -> isWord "TEMP" t || isWord "TEMPORARY" t) with
+    | k :: rest when isWord kind k -> Some rest
+    | _ -> None
+  | _ -> None
+
+/// <summary>
+/// Name of the trigger created by statement, and of the table it's on
+/// </summary>
+let createdTrigger (statement: Token list) =
+  created "TRIGGER" statement
+  |> Option.bind createdName
+  |> Option.bind (fun (name, rest) ->
+    match rest |> List.skipWhile (isWord "ON" >> not) with
+    | _ :: rest -> createdName rest |> Option.map (fun (table, _) -> name, table)
+    | [] -> None)
+
+/// <summary>
+/// Name of the table created by statement, without its quotes and the main schema
+/// </summary>
+let createdTable (statement: Token list) =
+  created "TABLE" statement |> Option.bind createdName |> Option.map fst
+
+/// <summary>
+/// Column definitions and table constraints in the parenthesized body of a CREATE TABLE statement.
+/// A comment on the line where a definition ends trails it, even after its comma, instead of leading the next one
+/// </summary>
+let tableDefinitions (statement: Token list) =
+  let opening, body =
+    match statement |> List.skipWhile (fun t -> isComment t || t.text <> "(") with
+    | opening :: body -> opening.line, body
+    | [] -> 0, []
+
+  let body =
+    body
+    |> List.mapFold
+      (fun depth t ->
+        let depth =
+          match t.text with
+          | "(" -> depth + 1
+          | ")" -> depth - 1
+          | _ -> depth
+
+        (t, depth), depth)
+      1
+    |> fst
+    |> List.takeWhile (fun (_, depth) -> depth > 0)
+
+  let split (defs, current) (t: Token, depth) =
+    if t.text = "," && depth = 1 then
+      List.rev current :: defs, []
+    else
+      defs, t :: current
+
+  let defs, last = body |> List.fold split ([], [])
+  let defs = List.rev last :: defs |> List.rev
+
+  let definition previousLine (def: Token list, next: Token list) =
+    let tokens = def |> List.filter (isComment >> not)
+    let line = tokens |> List.tryLast |> Option.map _.line |> Option.defaultValue previousLine
+    let comments (ts: Token list) = ts |> List.takeWhile isComment
+
+    { tokens = tokens
+      leading = comments def |> List.filter (fun c -> c.line <> previousLine)
+      trailing =
+        (def |> List.rev |> comments |> List.rev) @ comments next
+        |> List.filter (fun c -> c.line = line) },
+    line
+
+  List.zip defs (List.tail defs @ [ [] ])
+  |> List.mapFold definition opening
+  |> fst
+  |> List.filter (fun d -> not d.tokens.IsEmpty)
+
+/// <summary>
+/// Type of the column definition d as written in sql, from the column name up to its first constraint.
+/// It's empty for columns declared without a type
+/// </summary>
+let declaredType (sql: string) (d: Definition) =
+  let constraintStart (t: Token) =
+    [ "CONSTRAINT"; "PRIMARY"; "NOT"; "NULL"; "UNIQUE"; "CHECK"; "DEFAULT"; "COLLATE"; "REFERENCES"; "GENERATED"; "AS" ]
+    |> List.exists (fun w -> isWord w t)
+
+  match d.tokens |> List.tail |> List.takeWhile (constraintStart >> not) with
+  | [] -> ""
+  | ts -> span sql ts
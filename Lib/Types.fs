@@ -17,22 +17,43 @@ module Migrate.Types
 type SqlType =
   | SqlInteger
   | SqlText
+  | SqlReal
+  | SqlBlob
+  /// numeric affinity, with the declared type like DECIMAL(10,2), BOOLEAN or DATE
+  | SqlNumeric of string
 
 type Autoincrement = Autoincrement
 
 type Expr =
   | String of string
   | Integer of int
+  | Real of float
+  | Blob of byte array
 
 type InsertInto =
   { table: string
     columns: string list
     values: Expr list list }
 
+type ForeignKeyAction =
+  | Cascade
+  | SetNull
+  | SetDefault
+  | Restrict
+  | NoAction
+
 type ForeignKey =
   { columns: string list
     refTable: string
-    refColumns: string list }
+    refColumns: string list
+    onDelete: ForeignKeyAction option
+    onUpdate: ForeignKeyAction option
+    /// checked when the transaction commits instead of after each statement (DEFERRABLE INITIALLY DEFERRED)
+    deferred: bool }
+
+type GeneratedStorage =
+  | Stored
+  | Virtual
 
 type ColumnConstraint =
   | PrimaryKey of string list
@@ -40,30 +61,74 @@ type ColumnConstraint =
   | NotNull
   | Unique of string list
   | Default of Expr
+  /// default value that isn't a literal, like CURRENT_TIMESTAMP or an expression between parentheses
+  | DefaultExpr of string
+  | Check of string
+  | Generated of string * GeneratedStorage
+  | Collate of string
   | ForeignKey of ForeignKey
 
 type ColumnDef =
   { name: string
     columnType: SqlType
+    /// type as written in the SQL declaring the column, like VARCHAR(255)
+    declaredType: string option
     constraints: ColumnConstraint list }
 
-type CreateView = { name: string; selectUnion: string }
+type CreateView =
+  { name: string
+    selectUnion: string
+    columns: string list
+    /// created with CREATE TEMP, so it lasts while the connection creating it is open
+    temporary: bool }
+
+/// <summary>
+/// Table implemented by a SQLite module like fts5 or rtree, with the arguments given to it
+/// </summary>
+type CreateVirtualTable =
+  { name: string
+    moduleName: string
+    moduleArgs: string list }
 
 type CreateTable =
   { name: string
     columns: ColumnDef list
-    constraints: ColumnConstraint list }
+    constraints: ColumnConstraint list
+    /// names of the columns replaced by the ones declared after a `-- @renamed-from` comment
+    renamedColumns: Map<string, string>
+    /// values of the `-- @key value` comments before the statement creating the table
+    annotations: Map<string, string>
+    /// `-- comment` after the definition of every commented column, kept by SQLite in the table's SQL
+    columnComments: Map<string, string>
+    withoutRowid: bool
+    strict: bool
+    /// created with CREATE TEMP, so it lasts while the connection creating it is open
+    temporary: bool }
+
+/// <summary>
+/// Trigger on table, kept as the SQL text creating it
+/// </summary>
+type CreateTrigger =
+  { name: string
+    table: string
+    sql: string
+    /// created with CREATE TEMP, so it lasts while the connection creating it is open
+    temporary: bool }
 
 type CreateIndex =
   { name: string
     table: string
-    columns: string list }
+    columns: string list
+    where: string option
+    unique: bool }
 
 type SqlFile =
   { inserts: InsertInto list
     views: CreateView list
     tables: CreateTable list
-    indexes: CreateIndex list }
+    indexes: CreateIndex list
+    virtualTables: CreateVirtualTable list
+    triggers: CreateTrigger list }
 
 
 type TableSync = { table: string; idCol: int }
@@ -126,12 +191,61 @@ type Diff =
 
 type SolverProposal =
   { reason: Diff
-    statements: string list }
+    statements: string list
+    /// table the statements rebuild, creating it as `{table}_aux` and renaming it after copying the rows
+    rebuilds: string option
+    /// what to review before applying the statements, like a table dropped instead of renamed
+    warning: string option
+    /// the statements can lose data, dropping it or discarding the rows a rebuilt table rejects
+    destructive: bool }
+
+/// <summary>
+/// Decides which tables and columns of two schemas are the same, so they are compared
+/// instead of being removed and added. The built-in one matches them by name
+/// </summary>
+type Differ =
+  {
+    /// <summary>
+    /// Whether a table in the current schema is the same as one in the desired schema
+    /// </summary>
+    sameTable: CreateTable -> CreateTable -> bool
+
+    /// <summary>
+    /// Whether a column of a table in the current schema is the same as one of that table
+    /// in the desired schema
+    /// </summary>
+    sameColumn: ColumnDef -> ColumnDef -> bool
+  }
+
+type SchemaDiff =
+  { tables: Diff list
+    columns: Diff list
+    views: Diff list
+    indexes: Diff list }
+
+type LintWarning =
+  /// foreign key of a table whose columns don't start any of its indexes
+  | UnindexedForeignKey of table: string * columns: string list
+  /// index whose columns start another index of the same table, which serves its queries as well
+  | RedundantIndex of index: string * coveredBy: string
+
+type AnnotatedStatement =
+  { sql: string
+    destructive: bool
+    reason: Diff }
+
+type DownMigration =
+  { reverting: string list
+    /// statements of the forward migration losing data, which reverting it doesn't bring back
+    irreversible: AnnotatedStatement list }
 
 type ProposalResult =
   { reason: Diff
     statements: string list
-    error: string option }
+    error: string option
+    rebuilds: string option
+    warning: string option
+    destructive: bool }
 
 type MigrationIntent =
   { versionRemarks: string
@@ -146,6 +260,65 @@ type Migration =
     versionRemarks: string
     sqlSteps: SqlStep list }
 
+type MigrationPlan =
+  { steps: ProposalResult list
+    /// tables referenced by foreign keys in the desired schema
+    referencedTables: Set<string> }
+
+/// <summary>
+/// Quotes wrapping identifiers that are keywords or not plain names, like "order" or `order`
+/// </summary>
+type QuoteStyle =
+  | DoubleQuotes
+  | Backticks
+
+type MigrationOptions =
+  {
+    /// <summary>
+    /// Creates tables, views and indexes with IF NOT EXISTS, so a partially applied migration can be run again.
+    /// Table rebuilds start by dropping the auxiliary table a previous run could have left
+    /// </summary>
+    ifNotExists: bool
+
+    /// <summary>
+    /// Wraps the statements in a transaction, so a failing one leaves the database unchanged.
+    /// When tables referenced by foreign keys are rebuilt, foreign keys are disabled before the
+    /// transaction starts and enabled after it ends, since SQLite ignores that pragma inside a transaction.
+    /// Without a transaction they are disabled around each of those rebuilds
+    /// </summary>
+    transaction: bool
+
+    /// <summary>
+    /// Renames the columns declared after a `-- @renamed-from` comment by rebuilding their table,
+    /// for SQLite versions before 3.25 that lack ALTER TABLE ... RENAME COLUMN
+    /// </summary>
+    rebuildRenamedColumns: bool
+
+    /// <summary>
+    /// Quotes wrapping the identifiers in the statements that need them
+    /// </summary>
+    quoteStyle: QuoteStyle
+
+    /// <summary>
+    /// Creates the temporary tables, views and triggers after the migration. They are left out
+    /// of it otherwise, since the database doesn't keep them
+    /// </summary>
+    temporary: bool
+
+    /// <summary>
+    /// Expressions filling the columns of a rebuilt table from its old rows, by table and column name.
+    /// Columns without one are copied from their old name, and new columns get their default value.
+    /// A new column with an expression makes its table be rebuilt, so the expression can read the dropped columns.
+    /// An expression like COALESCE(name, 'unknown') fills the nulls of a column becoming NOT NULL
+    /// </summary>
+    copyColumns: Map<string, Map<string, string>>
+
+    /// <summary>
+    /// Runs ANALYZE after creating or dropping indexes, so the query planner statistics account for them
+    /// </summary>
+    analyze: bool
+  }
+
 exception MalformedProject of string
 exception ExpectingEnvVar of string
 exception NoDefaultValueForColumn of string
@@ -174,3 +347,6 @@ exception FailedParse of string
 type OpenError = { dbFile: string; msg: string }
 exception FailedOpenDb of OpenError
 exception StaleMigration of ProposalResult list
+exception DependencyCycle of string list
+exception MissingDependencies of relations: string list * dependencies: string list
+exception AttachedSchemaObject of string
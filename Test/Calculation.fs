@@ -17,12 +17,15 @@ module Migration
 open Migrate.Types
 open Migrate.Calculation.Migration
 open Xunit
+open Util
 
 let emptySchema =
   { inserts = []
     tables = []
     views = []
-    indexes = [] }
+    indexes = []
+    virtualTables = []
+    triggers = [] }
 
 let emptyProject =
   { versionRemarks = "empty project"
@@ -36,54 +39,39 @@ let emptyProject =
 let schemaWithOneTable (tableName: string) =
   { emptySchema with
       tables =
-        [ { name = tableName
-            columns =
-              [ { name = "id"
-                  columnType = SqlInteger
-                  constraints = [ NotNull ] } ]
-            constraints = [] } ] }
+        [ table tableName [ column "id" SqlInteger [ NotNull ] ] [] ] }
 
 let schemaWithUnique (tableName: string) =
   { emptySchema with
       tables =
-        [ { name = tableName
-            columns =
-              [ { name = "id"
-                  columnType = SqlInteger
-                  constraints = [ NotNull ] } ]
-            constraints = [ Unique [ "id" ] ] } ] }
+        [ table tableName [ column "id" SqlInteger [ NotNull ] ] [ Unique [ "id" ] ] ] }
 
 let schemaWithView (viewName: string) =
   { emptySchema with
+      tables = (schemaWithOneTable "table0").tables
       views =
         [ { name = viewName
-            selectUnion = "SELECT * FROM table0" } ] }
+            selectUnion = "SELECT * FROM table0"
+            columns = []
+            temporary = false } ] }
 
 let schemaWithTwoCols =
   { emptySchema with
       tables =
-        [ { name = "table0"
-            columns =
-              [ { name = "id"
-                  columnType = SqlInteger
-                  constraints = [ NotNull ] }
-                { name = "column1"
-                  columnType = SqlText
-                  constraints = [ NotNull; Default(String "bla") ] } ]
-            constraints = [] } ] }
+        [ table
+            "table0"
+            [ column "id" SqlInteger [ NotNull ]
+              column "column1" SqlText [ NotNull; Default(String "bla") ] ]
+            [] ] }
 
 let schemaWithTwoColsNewName =
   { emptySchema with
       tables =
-        [ { name = "table0"
-            columns =
-              [ { name = "id"
-                  columnType = SqlInteger
-                  constraints = [ NotNull ] }
-                { name = "column2"
-                  columnType = SqlText
-                  constraints = [ NotNull; Default(String "bla") ] } ]
-            constraints = [] } ] }
+        [ table
+            "table0"
+            [ column "id" SqlInteger [ NotNull ]
+              column "column2" SqlText [ NotNull; Default(String "bla") ] ]
+            [] ] }
 
 let insertWithVar =
   { table = "table0"
@@ -112,12 +100,29 @@ let addTable () =
   let expected: list<SolverProposal> option =
     Some
       [ { reason = Added "table0"
-          statements = [ "CREATE TABLE table0(id integer NOT NULL)" ] } ]
+          statements = [ "CREATE TABLE table0(id integer NOT NULL)" ]
+          rebuilds = None
+          warning = None
+          destructive = false } ]
 
   Assert.Equal(expected, r)
 
 [<Fact>]
-let possibleRenameTable () =
+let removeTable () =
+  let r = migration (schemaWithOneTable "table0") emptyProject
+
+  let expected: list<SolverProposal> option =
+    Some
+      [ { reason = Removed "table0"
+          statements = [ "DROP TABLE table0" ]
+          rebuilds = None
+          warning = None
+          destructive = true } ]
+
+  Assert.Equal(expected, r)
+
+[<Fact>]
+let renameTable () =
   let p =
     { emptyProject with
         source = schemaWithOneTable "table1" }
@@ -125,12 +130,95 @@ let possibleRenameTable () =
   let dbSchema = schemaWithOneTable "table0"
   let r = migration dbSchema p
 
+  let expected: list<SolverProposal> option =
+    Some
+      [ { reason = Changed("table0", "table1")
+          statements = [ "ALTER TABLE table0 RENAME TO table1" ]
+          rebuilds = None
+          warning = None
+          destructive = false } ]
+
+  Assert.Equal(expected, r)
+
+[<Fact>]
+let renameTableReorderedColumns () =
+  let p =
+    { emptyProject with
+        source =
+          { emptySchema with
+              tables =
+                [ { schemaWithTwoCols.tables.Head with
+                      name = "table1"
+                      columns = List.rev schemaWithTwoCols.tables.Head.columns } ] } }
+
+  let r = migration schemaWithTwoCols p
+
+  let expected: list<SolverProposal> option =
+    Some
+      [ { reason = Changed("table0", "table1")
+          statements = [ "ALTER TABLE table0 RENAME TO table1" ]
+          rebuilds = None
+          warning = None
+          destructive = false } ]
+
+  Assert.Equal(expected, r)
+
+[<Fact>]
+let ambiguousRenameTable () =
+  let p =
+    { emptyProject with
+        source =
+          { emptySchema with
+              tables = (schemaWithOneTable "table1").tables @ (schemaWithOneTable "table2").tables } }
+
+  let dbSchema = schemaWithOneTable "table0"
+  let r = migration dbSchema p
+
+  let expected: list<SolverProposal> option =
+    Some
+      [ { reason = Removed "table0"
+          statements = [ "DROP TABLE table0" ]
+          rebuilds = None
+          warning = Some "table0 matches table1, table2 and the rename is ambiguous, so it's dropped instead of renamed"
+          destructive = true }
+        { reason = Added "table1"
+          statements = [ "CREATE TABLE table1(id integer NOT NULL)" ]
+          rebuilds = None
+          warning = None
+          destructive = false }
+        { reason = Added "table2"
+          statements = [ "CREATE TABLE table2(id integer NOT NULL)" ]
+          rebuilds = None
+          warning = None
+          destructive = false } ]
+
+  Assert.Equal(expected, r)
+
+[<Fact>]
+let replaceTable () =
+  let table1 =
+    { (schemaWithOneTable "table1").tables.Head with
+        constraints = [ Unique [ "id" ] ] }
+
+  let p =
+    { emptyProject with
+        source = { emptySchema with tables = [ table1 ] } }
+
+  let dbSchema = schemaWithOneTable "table0"
+  let r = migration dbSchema p
+
   let expected: list<SolverProposal> option =
     Some
       [ { reason = Removed "table0"
-          statements = [ "DROP TABLE table0" ] }
+          statements = [ "DROP TABLE table0" ]
+          rebuilds = None
+          warning = None
+          destructive = true }
         { reason = Added "table1"
-          statements = [ "CREATE TABLE table1(id integer NOT NULL)" ] } ]
+          statements = [ "CREATE TABLE table1(id integer NOT NULL, UNIQUE(id))" ]
+          rebuilds = None
+          warning = None
+          destructive = false } ]
 
   Assert.Equal(expected, r)
 
@@ -146,15 +234,23 @@ let addView () =
   let expected: list<SolverProposal> option =
     Some
       [ { reason = Removed "view0"
-          statements = [ "DROP VIEW view0" ] }
+          statements = [ "DROP VIEW view0" ]
+          rebuilds = None
+          warning = None
+          destructive = false }
         { reason = Added "view1"
-          statements = [ "CREATE VIEW view1 AS\nSELECT * FROM table0" ] } ]
+          statements = [ "CREATE VIEW view1 AS\nSELECT * FROM table0" ]
+          rebuilds = None
+          warning = None
+          destructive = false } ]
 
   Assert.Equal(expected, r)
 
 [<Fact>]
 let removeView () =
-  let p = emptyProject
+  let p =
+    { emptyProject with
+        source = schemaWithOneTable "table0" }
 
   let dbSchema = schemaWithView "view0"
   let r = migration dbSchema p
@@ -162,7 +258,10 @@ let removeView () =
   let expected: list<SolverProposal> option =
     Some
       [ { reason = Removed "view0"
-          statements = [ "DROP VIEW view0" ] } ]
+          statements = [ "DROP VIEW view0" ]
+          rebuilds = None
+          warning = None
+          destructive = false } ]
 
   Assert.Equal(expected, r)
 
@@ -178,9 +277,15 @@ let renameView () =
   let expected: list<SolverProposal> option =
     Some
       [ { reason = Removed "view0"
-          statements = [ "DROP VIEW view0" ] }
+          statements = [ "DROP VIEW view0" ]
+          rebuilds = None
+          warning = None
+          destructive = false }
         { reason = Added "view1"
-          statements = [ "CREATE VIEW view1 AS\nSELECT * FROM table0" ] } ]
+          statements = [ "CREATE VIEW view1 AS\nSELECT * FROM table0" ]
+          rebuilds = None
+          warning = None
+          destructive = false } ]
 
   Assert.Equal(expected, r)
 
@@ -195,7 +300,10 @@ let addColumn () =
   let expected: list<SolverProposal> option =
     Some
       [ { reason = Added "column1 text"
-          statements = [ "ALTER TABLE table0 ADD COLUMN column1 text NOT NULL DEFAULT 'bla'" ] } ]
+          statements = [ "ALTER TABLE table0 ADD COLUMN column1 text NOT NULL DEFAULT 'bla'" ]
+          rebuilds = None
+          warning = None
+          destructive = false } ]
 
   Assert.Equal(expected, r)
 
@@ -210,7 +318,10 @@ let dropColumn () =
   let expected: list<SolverProposal> option =
     Some
       [ { reason = Removed "column1 text"
-          statements = [ "ALTER TABLE table0 DROP COLUMN column1" ] } ]
+          statements = [ "ALTER TABLE table0 DROP COLUMN column1" ]
+          rebuilds = None
+          warning = None
+          destructive = true } ]
 
   Assert.Equal(expected, r)
 
@@ -225,9 +336,134 @@ let possibleRenameColumn () =
   let expected: list<SolverProposal> option =
     Some
       [ { reason = Removed "column1 text"
-          statements = [ "ALTER TABLE table0 DROP COLUMN column1" ] }
+          statements = [ "ALTER TABLE table0 DROP COLUMN column1" ]
+          rebuilds = None
+          warning = None
+          destructive = true }
         { reason = Added "column2 text"
-          statements = [ "ALTER TABLE table0 ADD COLUMN column2 text NOT NULL DEFAULT 'bla'" ] } ]
+          statements = [ "ALTER TABLE table0 ADD COLUMN column2 text NOT NULL DEFAULT 'bla'" ]
+          rebuilds = None
+          warning = None
+          destructive = false } ]
+
+  Assert.Equal(expected, r)
+
+[<Fact>]
+let renamedFromColumn () =
+  let table0 = schemaWithTwoCols.tables.Head
+
+  // the renamed column changes its position, with column3 taking the one column1 had.
+  // Renames come before the other column changes, column3 is added by the next step
+  let table1 =
+    { table0 with
+        columns =
+          [ table0.columns.Head
+            { table0.columns[1] with name = "column3" }
+            { table0.columns[1] with name = "column2" } ]
+        renamedColumns = Map [ "column2", "column1" ] }
+
+  let p =
+    { emptyProject with
+        source = { emptySchema with tables = [ table1 ] } }
+
+  let r = migration schemaWithTwoCols p
+
+  let expected: list<SolverProposal> option =
+    Some
+      [ { reason = Changed("column1 text", "column2 text")
+          statements = [ "ALTER TABLE table0 RENAME COLUMN column1 TO column2" ]
+          rebuilds = None
+          warning = None
+          destructive = false } ]
+
+  Assert.Equal(expected, r)
+
+[<Fact>]
+let renamedFromColumnRebuild () =
+  let table0 = schemaWithTwoColsNewName.tables.Head
+
+  let p =
+    { emptyProject with
+        source =
+          { emptySchema with
+              tables =
+                [ { table0 with
+                      renamedColumns = Map [ "column2", "column1" ] } ] } }
+
+  let r = columnsMigrationWith true Map.empty schemaWithTwoCols p
+
+  let expected: list<SolverProposal> =
+    [ { reason = Changed("column1 text NOT NULL DEFAULT 'bla'", "column2 text NOT NULL DEFAULT 'bla'")
+        statements =
+          [ "CREATE TABLE table0_aux(id integer NOT NULL, column2 text NOT NULL DEFAULT 'bla')"
+            "INSERT OR IGNORE INTO table0_aux(id, column2) SELECT id, column1 FROM table0"
+            "DROP TABLE table0"
+            "ALTER TABLE table0_aux RENAME TO table0" ]
+        rebuilds = Some "table0"
+        warning = None
+        destructive = false } ]
+
+  Assert.Equal<SolverProposal list>(expected, r)
+
+[<Fact>]
+let renamedFromTable () =
+  let users =
+    { schemaWithTwoCols.tables.Head with
+        name = "users"
+        annotations = Map [ "renamed-from", "table0" ] }
+
+  // table1 has the structure table0 had, still table0 is only renamed to the table declaring it
+  let p =
+    { emptyProject with
+        source =
+          { emptySchema with
+              tables = [ users; (schemaWithOneTable "table1").tables.Head ] } }
+
+  let r = migration (schemaWithOneTable "table0") p
+
+  let expected: list<SolverProposal> option =
+    Some
+      [ { reason = Added "table1"
+          statements = [ "CREATE TABLE table1(id integer NOT NULL)" ]
+          rebuilds = None
+          warning = None
+          destructive = false }
+        { reason = Changed("table0", "users")
+          statements = [ "ALTER TABLE table0 RENAME TO users" ]
+          rebuilds = None
+          warning = None
+          destructive = false } ]
+
+  Assert.Equal(expected, r)
+
+[<Fact>]
+let rowidAliasChange () =
+  let table0 declaredType =
+    table
+      "table0"
+      [ { column "id" SqlInteger [ PrimaryKey [] ] with
+            declaredType = Some declaredType } ]
+      []
+
+  // INT PRIMARY KEY doesn't alias the rowid, turning it into INTEGER PRIMARY KEY rebuilds the table.
+  // Rows with ids the rowid doesn't accept, like NULL or text, are lost
+  let p =
+    { emptyProject with
+        source = { emptySchema with tables = [ table0 "INTEGER" ] } }
+
+  let r = migration { emptySchema with tables = [ table0 "INT" ] } p
+
+  let expected: list<SolverProposal> option =
+    Some
+      [ { reason = Changed("id INT PRIMARY KEY", "id INTEGER PRIMARY KEY")
+          statements =
+            [ "CREATE TABLE table0_aux(id INTEGER PRIMARY KEY)"
+              "INSERT OR IGNORE INTO table0_aux(id) SELECT id FROM table0"
+              "DROP TABLE table0"
+              "ALTER TABLE table0_aux RENAME TO table0" ]
+          rebuilds = Some "table0"
+          warning = None
+          destructive = true } ]
 
   Assert.Equal(expected, r)
 
@@ -246,7 +482,10 @@ let addUniqueConstraint () =
             [ "CREATE TABLE table0_aux(id integer NOT NULL, UNIQUE(id))"
               "INSERT OR IGNORE INTO table0_aux(id) SELECT id FROM table0"
               "DROP TABLE table0"
-              "ALTER TABLE table0_aux RENAME TO table0" ] } ]
+              "ALTER TABLE table0_aux RENAME TO table0" ]
+          rebuilds = Some "table0"
+          warning = None
+          destructive = true } ]
 
   Assert.Equal(expected, r)
 
@@ -269,3 +508,1429 @@ let uniqueToPrimaryKey () =
   r.IsSome |> Assert.True
   let v = r.Value
   Assert.Equal(v.Head.reason, Changed("id integer NOT NULL", "id integer PRIMARY KEY"))
+
+[<Fact>]
+let addNotNull () =
+  let schema0 = schemaWithOneTable "table0"
+  let table0 = schema0.tables.Head
+  let column0 = table0.columns.Head
+
+  let nullable =
+    { schema0 with
+        tables =
+          [ { table0 with
+                columns = [ { column0 with constraints = [] } ] } ] }
+
+  let p = { emptyProject with source = schema0 }
+  let r = migration nullable p
+
+  let expected: list<SolverProposal> option =
+    Some
+      [ { reason = Changed("id integer ", "id integer NOT NULL")
+          statements =
+            [ "CREATE TABLE table0_aux(id integer NOT NULL)"
+              "INSERT INTO table0_aux(id) SELECT id FROM table0"
+              "DROP TABLE table0"
+              "ALTER TABLE table0_aux RENAME TO table0" ]
+          rebuilds = Some "table0"
+          warning = None
+          destructive = false } ]
+
+  Assert.Equal(expected, r)
+
+[<Fact>]
+let dropNotNull () =
+  let schema0 = schemaWithOneTable "table0"
+  let table0 = schema0.tables.Head
+  let column0 = table0.columns.Head
+
+  let nullable =
+    { schema0 with
+        tables =
+          [ { table0 with
+                columns = [ { column0 with constraints = [] } ] } ] }
+
+  let p = { emptyProject with source = nullable }
+  let r = migration schema0 p
+
+  let expected: list<SolverProposal> option =
+    Some
+      [ { reason = Changed("id integer NOT NULL", "id integer ")
+          statements =
+            [ "CREATE TABLE table0_aux(id integer )"
+              "INSERT OR IGNORE INTO table0_aux(id) SELECT id FROM table0"
+              "DROP TABLE table0"
+              "ALTER TABLE table0_aux RENAME TO table0" ]
+          rebuilds = Some "table0"
+          warning = None
+          destructive = false } ]
+
+  Assert.Equal(expected, r)
+
+[<Fact>]
+let addNotNullWithDefault () =
+  let table0 constraints =
+    table "table0" [ column "id" SqlInteger [ NotNull ]; column "name" SqlText constraints ] []
+
+  let nullable = { emptySchema with tables = [ table0 [] ] }
+
+  let p =
+    { emptyProject with
+        source =
+          { emptySchema with
+              tables = [ table0 [ NotNull; Default(String "none") ] ] } }
+
+  let expected (backfill: string) : list<SolverProposal> option =
+    Some
+      [ { reason = Changed("name text ", "name text NOT NULL DEFAULT 'none'")
+          statements =
+            [ "CREATE TABLE table0_aux(id integer NOT NULL, name text NOT NULL DEFAULT 'none')"
+              $"INSERT OR IGNORE INTO table0_aux(id, name) SELECT id, {backfill} FROM table0"
+              "DROP TABLE table0"
+              "ALTER TABLE table0_aux RENAME TO table0" ]
+          rebuilds = Some "table0"
+          warning = None
+          destructive = false } ]
+
+  // nulls get the default, or the value of the expression copying the column
+  Assert.Equal(expected "COALESCE(name, 'none')", migration nullable p)
+
+  let copyColumns = Map [ "table0", Map [ "name", "COALESCE(name, 'unknown')" ] ]
+
+  Assert.Equal(
+    expected "COALESCE(name, 'unknown')"
+    |> Option.map (List.map (fun s -> { s with destructive = true })),
+    migrationWith false copyColumns nullable p
+  )
+
+[<Fact>]
+let viewDependencies () =
+  let schema =
+    { emptySchema with
+        tables = (schemaWithOneTable "table0").tables @ (schemaWithOneTable "table1").tables
+        views =
+          [ { name = "view0"
+              selectUnion = "SELECT a.id FROM table0 AS a JOIN table1 b ON a.id = b.id"
+              columns = []
+              temporary = false } ] }
+
+  let r = Migrate.Calculation.Dependencies.dependentRelations schema
+
+  let expected =
+    Map.ofList [ "table0", []; "table1", []; "view0", [ "table0"; "table1" ] ]
+
+  Assert.Equal<Map<string, string list>>(expected, r)
+
+[<Fact>]
+let recursiveViewDependencies () =
+  let schema =
+    { emptySchema with
+        tables = (schemaWithOneTable "table0").tables
+        views =
+          [ { name = "view0"
+              selectUnion =
+                "WITH RECURSIVE ids(n) AS (SELECT id FROM table0 UNION ALL SELECT n + 1 FROM ids WHERE n < 10), "
+                + "doubled AS (SELECT n * 2 AS d FROM ids) SELECT d FROM doubled"
+              columns = []
+              temporary = false } ] }
+
+  let r = Migrate.Calculation.Dependencies.dependentRelations schema
+  Assert.Equal<Map<string, string list>>(Map.ofList [ "table0", []; "view0", [ "table0" ] ], r)
+  Migrate.Calculation.Dependencies.checkDependencies schema
+
+[<Fact>]
+let viewDependencyCycle () =
+  let schema =
+    { emptySchema with
+        views =
+          [ { name = "view0"
+              selectUnion = "SELECT * FROM view1"
+              columns = []
+              temporary = false }
+            { name = "view1"
+              selectUnion = "SELECT * FROM view0"
+              columns = []
+              temporary = false } ] }
+
+  try
+    Migrate.Calculation.Dependencies.sortedRelations schema |> ignore
+    failwith "it should throw an exception because the views reference each other"
+  with DependencyCycle xs ->
+    Assert.Equal<string list>([ "view0"; "view1" ], xs)
+
+[<Fact>]
+let addAndDropColumns () =
+  let twoCols name =
+    { schemaWithTwoCols.tables.Head with name = name }
+
+  let oneCol name = (schemaWithOneTable name).tables.Head
+
+  let dbSchema =
+    { emptySchema with
+        tables = [ oneCol "table0"; twoCols "table1" ] }
+
+  let p =
+    { emptyProject with
+        source =
+          { emptySchema with
+              tables = [ twoCols "table0"; oneCol "table1" ] } }
+
+  let r = migration dbSchema p
+
+  let expected: list<SolverProposal> option =
+    Some
+      [ { reason = Added "column1 text"
+          statements = [ "ALTER TABLE table0 ADD COLUMN column1 text NOT NULL DEFAULT 'bla'" ]
+          rebuilds = None
+          warning = None
+          destructive = false }
+        { reason = Removed "column1 text"
+          statements = [ "ALTER TABLE table1 DROP COLUMN column1" ]
+          rebuilds = None
+          warning = None
+          destructive = true } ]
+
+  Assert.Equal(expected, r)
+
+[<Fact>]
+let changeView () =
+  let p =
+    { emptyProject with
+        source =
+          { schemaWithOneTable "table0" with
+              views =
+                [ { name = "view0"
+                    selectUnion = "SELECT id FROM table0"
+                    columns = []
+                    temporary = false } ] } }
+
+  let r = migration (schemaWithView "view0") p
+
+  let expected: list<SolverProposal> option =
+    Some
+      [ { reason = Removed "view0"
+          statements = [ "DROP VIEW view0" ]
+          rebuilds = None
+          warning = None
+          destructive = false }
+        { reason = Added "view0"
+          statements = [ "CREATE VIEW view0 AS\nSELECT id FROM table0" ]
+          rebuilds = None
+          warning = None
+          destructive = false } ]
+
+  Assert.Equal(expected, r)
+
+[<Fact>]
+let changeDependentViews () =
+  let views (select: string) =
+    { schemaWithOneTable "table0" with
+        views =
+          [ { name = "view1"
+              selectUnion = $"SELECT {select} FROM view0"
+              columns = []
+              temporary = false }
+            { name = "view0"
+              selectUnion = $"SELECT {select} FROM table0"
+              columns = []
+              temporary = false } ] }
+
+  let p = { emptyProject with source = views "id" }
+  let r = migration (views "*") p
+
+  let expected: list<SolverProposal> option =
+    Some
+      [ { reason = Removed "view1"
+          statements = [ "DROP VIEW view1" ]
+          rebuilds = None
+          warning = None
+          destructive = false }
+        { reason = Removed "view0"
+          statements = [ "DROP VIEW view0" ]
+          rebuilds = None
+          warning = None
+          destructive = false }
+        { reason = Added "view0"
+          statements = [ "CREATE VIEW view0 AS\nSELECT id FROM table0" ]
+          rebuilds = None
+          warning = None
+          destructive = false }
+        { reason = Added "view1"
+          statements = [ "CREATE VIEW view1 AS\nSELECT id FROM view0" ]
+          rebuilds = None
+          warning = None
+          destructive = false } ]
+
+  Assert.Equal(expected, r)
+
+[<Fact>]
+let changeIndexColumns () =
+  let withIndex (columns: string list) =
+    { schemaWithTwoCols with
+        indexes =
+          [ { name = "index0"
+              table = "table0"
+              columns = columns
+              where = None
+              unique = false } ] }
+
+  let p =
+    { emptyProject with
+        source = withIndex [ "id"; "column1" ] }
+
+  let r = migration (withIndex [ "id" ]) p
+
+  let expected: list<SolverProposal> option =
+    Some
+      [ { reason = Changed("index0 ON table0(id)", "index0 ON table0(id, column1)")
+          statements = [ "DROP INDEX index0"; "CREATE INDEX index0 ON table0(id, column1)" ]
+          rebuilds = None
+          warning = None
+          destructive = false } ]
+
+  Assert.Equal(expected, r)
+
+[<Fact>]
+let addIndex () =
+  let index0 =
+    { name = "index0"
+      table = "table0"
+      columns = [ "id" ]
+      where = None
+      unique = false }
+
+  let p =
+    { emptyProject with
+        source =
+          { schemaWithTwoCols with
+              indexes = [ index0 ] } }
+
+  let r = migration schemaWithTwoCols p
+
+  let expected: list<SolverProposal> option =
+    Some
+      [ { reason = Added "index0"
+          statements = [ "CREATE INDEX index0 ON table0(id)" ]
+          rebuilds = None
+          warning = None
+          destructive = false } ]
+
+  Assert.Equal(expected, r)
+
+let auditTrigger (body: string) =
+  { name = "trigger0"
+    table = "table0"
+    sql = $"CREATE TRIGGER trigger0 AFTER INSERT ON table0 BEGIN {body}; END"
+    temporary = false }
+
+[<Fact>]
+let changeTriggerBody () =
+  let withTrigger body =
+    { schemaWithTwoCols with
+        triggers = [ auditTrigger body ] }
+
+  let p =
+    { emptyProject with
+        source = withTrigger "UPDATE table0 SET column1 = 'new' WHERE id = NEW.id" }
+
+  let r = migration (withTrigger "UPDATE table0 SET column1 = 'old' WHERE id = NEW.id") p
+
+  let expected: list<SolverProposal> option =
+    Some
+      [ { reason = Removed "trigger0"
+          statements = [ "DROP TRIGGER IF EXISTS trigger0" ]
+          rebuilds = None
+          warning = None
+          destructive = false }
+        { reason = Added "trigger0"
+          statements =
+            [ "CREATE TRIGGER trigger0 AFTER INSERT ON table0 BEGIN UPDATE table0 SET column1 = 'new' WHERE id = NEW.id; END" ]
+          rebuilds = None
+          warning = None
+          destructive = false } ]
+
+  Assert.Equal(expected, r)
+
+  // reformatting the trigger doesn't change it
+  let reformatted =
+    withTrigger "UPDATE table0\n  SET column1 = 'new'\n  WHERE id = NEW.id"
+
+  Assert.Equal(None, migration reformatted p)
+
+[<Fact>]
+let triggerOnNewTable () =
+  let trigger = auditTrigger "UPDATE table0 SET column1 = 'new' WHERE id = NEW.id"
+
+  let p =
+    { emptyProject with
+        source =
+          { schemaWithTwoCols with
+              triggers = [ trigger ] } }
+
+  // the table is created first, and its trigger by the next step
+  let first = migration emptySchema p
+  let second = migration schemaWithTwoCols p
+
+  let expected: list<SolverProposal> option =
+    Some
+      [ { reason = Added "table0"
+          statements = [ "CREATE TABLE table0(id integer NOT NULL, column1 text NOT NULL DEFAULT 'bla')" ]
+          rebuilds = None
+          warning = None
+          destructive = false } ]
+
+  Assert.Equal(expected, first)
+
+  let expected: list<SolverProposal> option =
+    Some
+      [ { reason = Added "trigger0"
+          statements = [ trigger.sql ]
+          rebuilds = None
+          warning = None
+          destructive = false } ]
+
+  Assert.Equal(expected, second)
+
+[<Fact>]
+let removeTrigger () =
+  let p =
+    { emptyProject with
+        source = schemaWithTwoCols }
+
+  let r =
+    migration
+      { schemaWithTwoCols with
+          triggers = [ auditTrigger "DELETE FROM table0 WHERE id < 0" ] }
+      p
+
+  let expected: list<SolverProposal> option =
+    Some
+      [ { reason = Removed "trigger0"
+          statements = [ "DROP TRIGGER IF EXISTS trigger0" ]
+          rebuilds = None
+          warning = None
+          destructive = false } ]
+
+  Assert.Equal(expected, r)
+
+[<Fact>]
+let sortFile () =
+  let schema =
+    { emptySchema with
+        views =
+          [ { name = "view0"
+              selectUnion = "SELECT * FROM table0"
+              columns = []
+              temporary = false } ]
+        tables = (schemaWithOneTable "a_table").tables @ (schemaWithOneTable "table0").tables
+        indexes =
+          [ { name = "index0"
+              table = "table0"
+              columns = [ "id" ]
+              where = None
+              unique = false } ] }
+
+  let relations = Migrate.Calculation.Dependencies.sortedRelations schema
+  Assert.Equal<string list>([ "table0"; "view0"; "a_table" ], relations)
+
+  let sorted = Migrate.Calculation.Dependencies.sortFile schema
+  Assert.Equal<string list>([ "table0"; "a_table" ], sorted.tables |> List.map _.name)
+
+[<Fact>]
+let changeDefault () =
+  let withDefault (v: Expr) =
+    { emptySchema with
+        tables = [ table "table0" [ column "id" SqlInteger [ NotNull; Default v ] ] [] ] }
+
+  let p =
+    { emptyProject with
+        source = withDefault (Integer 1) }
+
+  let r = migration (withDefault (Integer 0)) p
+
+  let expected: list<SolverProposal> option =
+    Some
+      [ { reason = Changed("id integer NOT NULL DEFAULT 0", "id integer NOT NULL DEFAULT 1")
+          statements =
+            [ "CREATE TABLE table0_aux(id integer NOT NULL DEFAULT 1)"
+              "INSERT OR IGNORE INTO table0_aux(id) SELECT id FROM table0"
+              "DROP TABLE table0"
+              "ALTER TABLE table0_aux RENAME TO table0" ]
+          rebuilds = Some "table0"
+          warning = None
+          destructive = false } ]
+
+  Assert.Equal(expected, r)
+
+[<Fact>]
+let foreignKeyDependencies () =
+  let referencing =
+    { (schemaWithOneTable "a_table").tables.Head with
+        constraints =
+          [ ForeignKey
+              { columns = [ "id" ]
+                refTable = "b_table"
+                refColumns = [ "id" ]
+                onDelete = None
+                onUpdate = None
+                deferred = false } ] }
+
+  let schema =
+    { emptySchema with
+        tables = [ referencing; (schemaWithOneTable "b_table").tables.Head ] }
+
+  let relations = Migrate.Calculation.Dependencies.sortedRelations schema
+  Assert.Equal<string list>([ "b_table"; "a_table" ], relations)
+
+[<Fact>]
+let changeDeclaredTypeLength () =
+  let withType (declared: string) =
+    { emptySchema with
+        tables =
+          [ table
+              "table0"
+              [ column "id" SqlInteger [ NotNull ]
+                { column "name" SqlText [ NotNull ] with
+                    declaredType = Some declared } ]
+              [] ] }
+
+  let p =
+    { emptyProject with
+        source = withType "VARCHAR(255)" }
+
+  let r = migration (withType "VARCHAR(100)") p
+
+  let expected: list<SolverProposal> option =
+    Some
+      [ { reason = Changed("name VARCHAR(100) NOT NULL", "name VARCHAR(255) NOT NULL")
+          statements =
+            [ "CREATE TABLE table0_aux(id integer NOT NULL, name VARCHAR(255) NOT NULL)"
+              "INSERT OR IGNORE INTO table0_aux(id, name) SELECT id, name FROM table0"
+              "DROP TABLE table0"
+              "ALTER TABLE table0_aux RENAME TO table0" ]
+          rebuilds = Some "table0"
+          warning = None
+          destructive = true } ]
+
+  Assert.Equal(expected, r)
+
+  // type names are case insensitive
+  Assert.Equal(None, migration (withType "varchar(255)") p)
+
+let foreignKeyCycle () =
+  let references name refTable =
+    { (schemaWithOneTable name).tables.Head with
+        constraints =
+          [ ForeignKey
+              { columns = [ "id" ]
+                refTable = refTable
+                refColumns = [ "id" ]
+                onDelete = None
+                onUpdate = None
+                deferred = true } ] }
+
+  let schema =
+    { emptySchema with
+        tables =
+          [ references "b_table" "a_table"
+            references "a_table" "b_table"
+            references "c_table" "a_table" ] }
+
+  let relations = Migrate.Calculation.Dependencies.sortedRelations schema
+  Assert.Equal<string list>([ "a_table"; "c_table"; "b_table" ], relations)
+
+  let p = { emptyProject with source = schema }
+
+  let r = migration emptySchema p
+
+  let sqlReferences name refTable =
+    $"CREATE TABLE {name}(id integer NOT NULL, FOREIGN KEY(id) REFERENCES {refTable}(id) DEFERRABLE INITIALLY DEFERRED)"
+
+  let expected: list<SolverProposal> option =
+    Some
+      [ { reason = Added "a_table"
+          statements = [ sqlReferences "a_table" "b_table" ]
+          rebuilds = None
+          warning = None
+          destructive = false }
+        { reason = Added "c_table"
+          statements = [ sqlReferences "c_table" "a_table" ]
+          rebuilds = None
+          warning = None
+          destructive = false }
+        { reason = Added "b_table"
+          statements = [ sqlReferences "b_table" "a_table" ]
+          rebuilds = None
+          warning = None
+          destructive = false } ]
+
+  Assert.Equal(expected, r)
+
+[<Fact>]
+let severalForeignKeys () =
+  let foreignKey columns refTable =
+    ForeignKey
+      { columns = columns
+        refTable = refTable
+        refColumns = columns
+        onDelete = None
+        onUpdate = None
+        deferred = false }
+
+  let referencing =
+    { (schemaWithOneTable "a_table").tables.Head with
+        constraints =
+          [ foreignKey [ "id"; "name" ] "c_table"
+            foreignKey [ "id" ] "b_table"
+            foreignKey [ "name" ] "c_table" ] }
+
+  let schema =
+    { emptySchema with
+        tables =
+          [ referencing
+            (schemaWithOneTable "b_table").tables.Head
+            (schemaWithOneTable "c_table").tables.Head ] }
+
+  let dependencies = Migrate.Calculation.Dependencies.dependentRelations schema
+  Assert.Equal<string list>([ "c_table"; "b_table" ], dependencies["a_table"])
+
+  let relations = Migrate.Calculation.Dependencies.sortedRelations schema
+  Assert.Equal<string list>([ "b_table"; "c_table"; "a_table" ], relations)
+
+[<Fact>]
+let selfReferencingTable () =
+  let tree =
+    { (schemaWithOneTable "tree").tables.Head with
+        constraints =
+          [ ForeignKey
+              { columns = [ "id" ]
+                refTable = "tree"
+                refColumns = [ "id" ]
+                onDelete = None
+                onUpdate = None
+                deferred = false } ] }
+
+  let schema =
+    { emptySchema with
+        tables = [ tree; (schemaWithOneTable "table0").tables.Head ] }
+
+  let relations = Migrate.Calculation.Dependencies.sortedRelations schema
+  Assert.Equal<string list>([ "table0"; "tree" ], relations)
+
+[<Fact>]
+let selfReferencingTrigger () =
+  // an audit trigger named like the table it's defined on and updates
+  let trigger =
+    { name = "table0"
+      table = "table0"
+      sql = "CREATE TRIGGER table0 AFTER INSERT ON table0 BEGIN UPDATE table0 SET column1 = 'new' WHERE id = NEW.id; END"
+      temporary = false }
+
+  let schema =
+    { schemaWithTwoCols with
+        triggers = [ trigger ] }
+
+  let r = Migrate.Calculation.Dependencies.dependentRelations schema
+  Assert.Equal<Map<string, string list>>(Map.ofList [ "table0", [] ], r)
+  Assert.Equal<string list>([ "table0" ], Migrate.Calculation.Dependencies.sortedRelations schema)
+
+[<Fact>]
+let addWithoutRowid () =
+  // SQLite requires a PRIMARY KEY for WITHOUT ROWID tables
+  let table0 = table "table0" [ column "id" SqlInteger [ PrimaryKey [] ] ] []
+
+  let p =
+    { emptyProject with
+        source =
+          { emptySchema with
+              tables = [ { table0 with withoutRowid = true } ] } }
+
+  let r = migration { emptySchema with tables = [ table0 ] } p
+
+  let expected: list<SolverProposal> option =
+    Some
+      [ { reason = Changed("table0", "table0 WITHOUT ROWID")
+          statements =
+            [ "CREATE TABLE table0_aux(id integer PRIMARY KEY) WITHOUT ROWID"
+              "INSERT OR IGNORE INTO table0_aux(id) SELECT id FROM table0"
+              "DROP TABLE table0"
+              "ALTER TABLE table0_aux RENAME TO table0" ]
+          rebuilds = Some "table0"
+          warning = None
+          destructive = true } ]
+
+  Assert.Equal(expected, r)
+
+[<Fact>]
+let removeStrict () =
+  let table0 = (schemaWithOneTable "table0").tables.Head
+
+  let db =
+    { emptySchema with
+        tables = [ { table0 with strict = true } ] }
+
+  let p =
+    { emptyProject with
+        source = schemaWithOneTable "table0" }
+
+  let r = migration db p
+
+  let expected: list<SolverProposal> option =
+    Some
+      [ { reason = Changed("table0 STRICT", "table0")
+          statements =
+            [ "CREATE TABLE table0_aux(id integer NOT NULL)"
+              "INSERT OR IGNORE INTO table0_aux(id) SELECT id FROM table0"
+              "DROP TABLE table0"
+              "ALTER TABLE table0_aux RENAME TO table0" ]
+          rebuilds = Some "table0"
+          warning = None
+          destructive = false } ]
+
+  Assert.Equal(expected, r)
+
+[<Fact>]
+let missingViewDependency () =
+  let p =
+    { emptyProject with
+        source =
+          { schemaWithOneTable "table0" with
+              views =
+                [ { name = "view0"
+                    selectUnion = "SELECT t.id FROM tabel0 t JOIN table0 u ON t.id = u.id"
+                    columns = []
+                    temporary = false } ] } }
+
+  try
+    migration emptySchema p |> ignore
+    failwith "it should throw an exception because view0 selects from tabel0, which isn't defined"
+  with MissingDependencies(relations, dependencies) ->
+    Assert.Equal<string list>([ "view0" ], relations)
+    Assert.Equal<string list>([ "tabel0" ], dependencies)
+
+[<Fact>]
+let builtinViewDependencies () =
+  let schema =
+    { schemaWithOneTable "table0" with
+        views =
+          [ { name = "view0"
+              selectUnion = "SELECT name FROM sqlite_schema WHERE type = 'table'"
+              columns = []
+              temporary = false }
+            { name = "view1"
+              selectUnion = "SELECT t.name, c.name FROM sqlite_master t JOIN pragma_table_info(t.name) c"
+              columns = []
+              temporary = false } ] }
+
+  Migrate.Calculation.Dependencies.checkDependencies schema
+
+  let relations = Migrate.Calculation.Dependencies.sortedRelations schema
+  Assert.Equal<string list>([ "table0"; "view0"; "view1" ], relations)
+
+[<Fact>]
+let topologicalSortExample () =
+  let deps = Map.ofList [ "view0", [ "table0" ]; "table0", [ "table1" ]; "table1", [] ]
+  let r = Migrate.Checks.Algorithms.topologicalSortChecked (fun x -> deps[x]) [ "view0"; "table0"; "table1" ]
+  Assert.Equal(Ok [ "table1"; "table0"; "view0" ], r)
+
+[<Fact>]
+let topologicalSortDeterministic () =
+  let deps =
+    Map.ofList [ "view0", [ "table2"; "table0"; "table1" ]; "table1", []; "table0", []; "table2", [] ]
+
+  let sort () =
+    Migrate.Checks.Algorithms.topologicalSort (fun x -> deps[x]) [ "table2"; "view0"; "table1"; "table0" ]
+
+  let results = List.init 100 (fun _ -> sort ())
+  Assert.Equal<string list>([ "table0"; "table1"; "table2"; "view0" ], results.Head)
+  Assert.True(results |> List.forall ((=) results.Head))
+
+[<Fact>]
+let topologicalSortLongChain () =
+  let n = 5000
+  let node i = $"view{i:D4}"
+
+  let reference (x: string) =
+    match int x[4..] with
+    | 0 -> []
+    | i -> [ node (i - 1) ]
+
+  let xs = List.init n node |> List.rev
+  let r = Migrate.Checks.Algorithms.topologicalSort reference xs
+  Assert.Equal<string list>(List.init n node, r)
+
+[<Fact>]
+let stronglyConnectedExample () =
+  let deps = Map.ofList [ "a", [ "b" ]; "b", [ "a" ]; "c", [ "a" ]; "d", [ "d" ] ]
+  let r = Migrate.Checks.Algorithms.stronglyConnected (fun x -> deps[x]) [ "a"; "b"; "c"; "d" ]
+  Assert.Equal<string list list>([ [ "d" ]; [ "c" ]; [ "a"; "b" ] ], r)
+
+[<Fact>]
+let sortedRelationsLongForeignKeyChain () =
+  let n = 5000
+  let name i = $"table{i:D4}"
+
+  let references i =
+    [ ForeignKey
+        { columns = [ "id" ]
+          refTable = name (i - 1)
+          refColumns = [ "id" ]
+          onDelete = None
+          onUpdate = None
+          deferred = false } ]
+
+  let tables =
+    List.init n (fun i -> table (name i) [ column "id" SqlInteger [ NotNull ] ] (if i = 0 then [] else references i))
+    |> List.rev
+
+  let watch = System.Diagnostics.Stopwatch.StartNew()
+  let relations = Migrate.Calculation.Dependencies.sortedRelations { emptySchema with tables = tables }
+  watch.Stop()
+
+  Assert.Equal<string list>(List.init n name, relations)
+  Assert.True(watch.Elapsed.TotalSeconds < 5.0, $"sorting took {watch.Elapsed}")
+
+[<Fact>]
+let foreignKeyCreationOrder () =
+  let referencing =
+    { (schemaWithOneTable "a_table").tables.Head with
+        columns =
+          [ column
+              "b_id"
+              SqlInteger
+              [ ForeignKey
+                  { columns = []
+                    refTable = "b_table"
+                    refColumns = [ "id" ]
+                    onDelete = None
+                    onUpdate = None
+                    deferred = false } ] ] }
+
+  let schema =
+    { emptySchema with
+        tables = [ referencing; (schemaWithOneTable "b_table").tables.Head ] }
+
+  let created = migration emptySchema { emptyProject with source = schema }
+
+  let expected: list<SolverProposal> option =
+    Some
+      [ { reason = Added "b_table"
+          statements = [ "CREATE TABLE b_table(id integer NOT NULL)" ]
+          rebuilds = None
+          warning = None
+          destructive = false }
+        { reason = Added "a_table"
+          statements = [ "CREATE TABLE a_table(b_id integer REFERENCES b_table(id))" ]
+          rebuilds = None
+          warning = None
+          destructive = false } ]
+
+  Assert.Equal(expected, created)
+
+  let dropped = migration schema emptyProject
+
+  let expected: list<SolverProposal> option =
+    Some
+      [ { reason = Removed "a_table"
+          statements = [ "DROP TABLE a_table" ]
+          rebuilds = None
+          warning = None
+          destructive = true }
+        { reason = Removed "b_table"
+          statements = [ "DROP TABLE b_table" ]
+          rebuilds = None
+          warning = None
+          destructive = true } ]
+
+  Assert.Equal(expected, dropped)
+
+[<Fact>]
+let createDeleteSorted () =
+  let xs = [ "a"; "b"; "c" ]
+  let ys = [ "b"; "d"; "e" ]
+  let sql verb (x: string) = [ $"{verb} {x}" ]
+
+  let r = Migrate.Calculation.Solver.createDeleteSorted xs ys id id (sql "DROP") (sql "CREATE")
+
+  let expected: SolverProposal list =
+    [ { reason = Removed "c"
+        statements = [ "DROP c" ]
+        rebuilds = None
+        warning = None
+        destructive = false }
+      { reason = Removed "a"
+        statements = [ "DROP a" ]
+        rebuilds = None
+        warning = None
+        destructive = false }
+      { reason = Added "d"
+        statements = [ "CREATE d" ]
+        rebuilds = None
+        warning = None
+        destructive = false }
+      { reason = Added "e"
+        statements = [ "CREATE e" ]
+        rebuilds = None
+        warning = None
+        destructive = false } ]
+
+  Assert.Equal<SolverProposal list>(expected, r)
+  Assert.Empty(Migrate.Calculation.Solver.createDeleteSorted xs (List.rev xs) id id (sql "DROP") (sql "CREATE"))
+
+[<Fact>]
+let addGeneratedColumns () =
+  let withGenerated (storage: GeneratedStorage) =
+    { emptyProject with
+        source =
+          { emptySchema with
+              tables =
+                [ { (schemaWithOneTable "table0").tables.Head with
+                      columns =
+                        (schemaWithOneTable "table0").tables.Head.columns
+                        @ [ column "twice" SqlInteger [ Generated("id * 2", storage) ] ] } ] } }
+
+  let r = migration (schemaWithOneTable "table0") (withGenerated Virtual)
+
+  let expected: list<SolverProposal> option =
+    Some
+      [ { reason = Added "twice integer"
+          statements = [ "ALTER TABLE table0 ADD COLUMN twice integer GENERATED ALWAYS AS (id * 2) VIRTUAL" ]
+          rebuilds = None
+          warning = None
+          destructive = false } ]
+
+  Assert.Equal(expected, r)
+
+  let r = migration (schemaWithOneTable "table0") (withGenerated Stored)
+
+  let expected: list<SolverProposal> option =
+    Some
+      [ { reason = Added "twice integer"
+          statements =
+            [ "CREATE TABLE table0_aux(id integer NOT NULL, twice integer GENERATED ALWAYS AS (id * 2) STORED)"
+              "INSERT OR IGNORE INTO table0_aux(id) SELECT id FROM table0"
+              "DROP TABLE table0"
+              "ALTER TABLE table0_aux RENAME TO table0" ]
+          rebuilds = Some "table0"
+          warning = None
+          destructive = false } ]
+
+  Assert.Equal(expected, r)
+
+[<Fact>]
+let changeCollation () =
+  let withName (constraints: ColumnConstraint list) =
+    { emptySchema with
+        tables =
+          [ { (schemaWithOneTable "table0").tables.Head with
+                columns = [ column "name" SqlText constraints ] } ] }
+
+  let p =
+    { emptyProject with
+        source = withName [ Collate "NOCASE"; NotNull ] }
+
+  let r = migration (withName [ NotNull ]) p
+
+  let expected: list<SolverProposal> option =
+    Some
+      [ { reason = Changed("name text NOT NULL", "name text COLLATE NOCASE NOT NULL")
+          statements =
+            [ "CREATE TABLE table0_aux(name text COLLATE NOCASE NOT NULL)"
+              "INSERT OR IGNORE INTO table0_aux(name) SELECT name FROM table0"
+              "DROP TABLE table0"
+              "ALTER TABLE table0_aux RENAME TO table0" ]
+          rebuilds = Some "table0"
+          warning = None
+          destructive = true } ]
+
+  Assert.Equal(expected, r)
+
+[<Fact>]
+let changeIndexWhere () =
+  let withIndex (where: string) =
+    { schemaWithTwoCols with
+        indexes =
+          [ { name = "index0"
+              table = "table0"
+              columns = [ "id" ]
+              where = Some where
+              unique = false } ] }
+
+  let p =
+    { emptyProject with
+        source = withIndex "column1 = 'active'" }
+
+  let r = migration (withIndex "column1 <> 'deleted'") p
+
+  let expected: list<SolverProposal> option =
+    Some
+      [ { reason =
+            Changed("index0 ON table0(id) WHERE column1 <> 'deleted'", "index0 ON table0(id) WHERE column1 = 'active'")
+          statements = [ "DROP INDEX index0"; "CREATE INDEX index0 ON table0(id) WHERE column1 = 'active'" ]
+          rebuilds = None
+          warning = None
+          destructive = false } ]
+
+  Assert.Equal(expected, r)
+
+[<Fact>]
+let changeIndexExpression () =
+  let withIndex (column: string) =
+    { schemaWithTwoCols with
+        indexes =
+          [ { name = "index0"
+              table = "table0"
+              columns = [ column ]
+              where = None
+              unique = false } ] }
+
+  let p =
+    { emptyProject with
+        source = withIndex "upper(column1)" }
+
+  let r = migration (withIndex "lower(column1)") p
+
+  let expected: list<SolverProposal> option =
+    Some
+      [ { reason = Changed("index0 ON table0(lower(column1))", "index0 ON table0(upper(column1))")
+          statements = [ "DROP INDEX index0"; "CREATE INDEX index0 ON table0(upper(column1))" ]
+          rebuilds = None
+          warning = None
+          destructive = false } ]
+
+  Assert.Equal(expected, r)
+
+[<Fact>]
+let changeIndexOrder () =
+  let withIndex (column: string) =
+    { schemaWithTwoCols with
+        indexes =
+          [ { name = "index0"
+              table = "table0"
+              columns = [ column ]
+              where = None
+              unique = false } ] }
+
+  let p =
+    { emptyProject with
+        source = withIndex "id DESC" }
+
+  let r = migration (withIndex "id ASC") p
+
+  let expected: list<SolverProposal> option =
+    Some
+      [ { reason = Changed("index0 ON table0(id ASC)", "index0 ON table0(id DESC)")
+          statements = [ "DROP INDEX index0"; "CREATE INDEX index0 ON table0(id DESC)" ]
+          rebuilds = None
+          warning = None
+          destructive = false } ]
+
+  Assert.Equal(expected, r)
+
+[<Fact>]
+let changeIndexUnique () =
+  let withIndex (unique: bool) =
+    { schemaWithTwoCols with
+        indexes =
+          [ { name = "index0"
+              table = "table0"
+              columns = [ "column1" ]
+              where = None
+              unique = unique } ] }
+
+  let p =
+    { emptyProject with
+        source = withIndex true }
+
+  let r = migration (withIndex false) p
+
+  let expected: list<SolverProposal> option =
+    Some
+      [ { reason = Changed("index0 ON table0(column1)", "UNIQUE index0 ON table0(column1)")
+          statements = [ "DROP INDEX index0"; "CREATE UNIQUE INDEX index0 ON table0(column1)" ]
+          rebuilds = None
+          warning = None
+          destructive = false } ]
+
+  Assert.Equal(expected, r)
+
+[<Fact>]
+let annotateDestructiveStatements () =
+  let p =
+    { emptyProject with
+        source = schemaWithOneTable "table1" }
+
+  let annotated =
+    migration (schemaWithUnique "table0") p
+    |> Option.defaultValue []
+    |> List.collect (fun p -> annotateStatements p.reason p.destructive p.statements)
+
+  let expected: AnnotatedStatement list =
+    [ { sql = "DROP TABLE table0"
+        destructive = true
+        reason = Removed "table0" }
+      { sql = "CREATE TABLE table1(id integer NOT NULL)"
+        destructive = false
+        reason = Added "table1" } ]
+
+  Assert.Equal<AnnotatedStatement list>(expected, annotated)
+
+[<Fact>]
+let destructiveRebuilds () =
+  let withName (constraints: ColumnConstraint list) (declared: string) =
+    { emptySchema with
+        tables =
+          [ table
+              "table0"
+              [ column "id" SqlInteger [ NotNull ]
+                { column "name" SqlText constraints with
+                    declaredType = Some declared } ]
+              [] ] }
+
+  let destructive (current: SqlFile) (desired: SqlFile) =
+    migration current { emptyProject with source = desired }
+    |> Option.defaultValue []
+    |> List.map (fun p -> p.rebuilds, p.destructive)
+
+  let rebuilt = [ Some "table0", true ]
+  Assert.Equal<(string option * bool) list>(rebuilt, destructive (withName [] "TEXT") (withName [ Unique [] ] "TEXT"))
+  Assert.Equal<(string option * bool) list>(rebuilt, destructive (withName [] "TEXT") (withName [] "VARCHAR(10)"))
+
+  // without a default, copying the nulls of a column becoming NOT NULL fails instead of dropping their rows
+  let kept = [ Some "table0", false ]
+  Assert.Equal<(string option * bool) list>(kept, destructive (withName [ NotNull ] "TEXT") (withName [] "TEXT"))
+  Assert.Equal<(string option * bool) list>(kept, destructive (withName [] "TEXT") (withName [ NotNull ] "TEXT"))
+
+[<Fact>]
+let changeViewColumns () =
+  let withView (columns: string list) =
+    { schemaWithOneTable "table0" with
+        views =
+          [ { name = "view0"
+              selectUnion = "SELECT id FROM table0"
+              columns = columns
+              temporary = false } ] }
+
+  let p =
+    { emptyProject with
+        source = withView [ "key" ] }
+
+  let r = migration (withView [ "id" ]) p
+
+  let expected: list<SolverProposal> option =
+    Some
+      [ { reason = Removed "view0"
+          statements = [ "DROP VIEW view0" ]
+          rebuilds = None
+          warning = None
+          destructive = false }
+        { reason = Added "view0"
+          statements = [ "CREATE VIEW view0(\"key\") AS\nSELECT id FROM table0" ]
+          rebuilds = None
+          warning = None
+          destructive = false } ]
+
+  Assert.Equal(expected, r)
+
+[<Fact>]
+let temporaryRelations () =
+  let schemaWithTempView =
+    { schemaWithView "view0" with
+        views =
+          [ { name = "view0"
+              selectUnion = "SELECT * FROM table0"
+              columns = []
+              temporary = true } ] }
+
+  let p =
+    { emptyProject with
+        source = schemaWithTempView }
+
+  let r = migration (schemaWithOneTable "table0") p
+  Assert.Equal(None, r)
+
+  let expected: SolverProposal list =
+    [ { reason = Added "view0"
+        statements = [ "CREATE TEMP VIEW view0 AS\nSELECT * FROM table0" ]
+        rebuilds = None
+        warning = None
+        destructive = false } ]
+
+  Assert.Equal<SolverProposal list>(expected, temporaryMigration schemaWithTempView)
+
+[<Fact>]
+let compareSchemas () =
+  let table0 = schemaWithTwoCols.tables.Head
+
+  let right =
+    { emptySchema with
+        tables =
+          [ { table0 with
+                columns = [ table0.columns[0]; { table0.columns[1] with constraints = [ NotNull ] } ] }
+            (schemaWithOneTable "table1").tables.Head ] }
+
+  let diff = Migrate.Calculation.Migration.compareSchemas schemaWithTwoCols right
+
+  let expected =
+    { tables =
+        [ Added "table1"
+          Changed(
+            "CREATE TABLE table0(id integer NOT NULL, column1 text NOT NULL DEFAULT 'bla')",
+            "CREATE TABLE table0(id integer NOT NULL, column1 text NOT NULL)"
+          ) ]
+      columns = [ Changed("table0.column1 text NOT NULL DEFAULT 'bla'", "table0.column1 text NOT NULL") ]
+      views = []
+      indexes = [] }
+
+  Assert.Equal(expected, diff)
+
+[<Fact>]
+let compareSchemasWithDiffer () =
+  let withId (id: string) (t: CreateTable) =
+    { t with annotations = Map [ "id", id ] }
+
+  let left =
+    { emptySchema with
+        tables = [ table "users" [ column "id" SqlInteger [ NotNull ] ] [] |> withId "1" ] }
+
+  let right =
+    { emptySchema with
+        tables =
+          [ table "accounts" [ column "id" SqlInteger [ NotNull ]; column "name" SqlText [ NotNull ] ] []
+            |> withId "1" ] }
+
+  // tables with the same `-- @id` annotation are the same, whatever their names
+  let differ =
+    { defaultDiffer with
+        sameTable = fun x y -> x.annotations.TryFind "id" = y.annotations.TryFind "id" }
+
+  let expected =
+    { tables =
+        [ Changed(
+            "CREATE TABLE users(id integer NOT NULL)",
+            "CREATE TABLE accounts(id integer NOT NULL, name text NOT NULL)"
+          ) ]
+      columns = [ Added "accounts.name" ]
+      views = []
+      indexes = [] }
+
+  Assert.Equal(expected, Migrate.Calculation.Migration.compareSchemasWith differ left right)
+
+  let byName =
+    { tables = [ Removed "users"; Added "accounts" ]
+      columns = []
+      views = []
+      indexes = [] }
+
+  Assert.Equal(byName, Migrate.Calculation.Migration.compareSchemas left right)
+
+[<Fact>]
+let planJson () =
+  let plan =
+    [ { sql = "DROP TABLE table0"
+        destructive = true
+        reason = Removed "table0" }
+      { sql = "CREATE TABLE table1(id integer NOT NULL)"
+        destructive = false
+        reason = Added "table1" } ]
+
+  let expected =
+    """[{"destructive":true,"operation":"removed","sql":"DROP TABLE table0","target":"table0"},"""
+    + """{"destructive":false,"operation":"added","sql":"CREATE TABLE table1(id integer NOT NULL)","target":"table1"}]"""
+
+  Assert.Equal(expected, Migrate.Calculation.Migration.planJson plan)
+
+[<Fact>]
+let changeColumnType () =
+  let withCode (columnType: SqlType) =
+    { emptySchema with
+        tables =
+          [ { (schemaWithOneTable "table0").tables.Head with
+                columns =
+                  [ column "id" SqlInteger [ NotNull ]
+                    column "code" columnType [ NotNull ] ] } ] }
+
+  let p =
+    { emptyProject with
+        source = withCode SqlInteger }
+
+  let r = migration (withCode SqlText) p
+
+  let expected: list<SolverProposal> option =
+    Some
+      [ { reason = Changed("code text NOT NULL", "code integer NOT NULL")
+          statements =
+            [ "CREATE TABLE table0_aux(id integer NOT NULL, code integer NOT NULL)"
+              "INSERT OR IGNORE INTO table0_aux(id, code) SELECT id, CAST(code AS INTEGER) FROM table0"
+              "DROP TABLE table0"
+              "ALTER TABLE table0_aux RENAME TO table0" ]
+          rebuilds = Some "table0"
+          warning = None
+          destructive = true } ]
+
+  Assert.Equal(expected, r)
+
+[<Fact>]
+let changeColumnTypesOnce () =
+  let withColumns (code: SqlType) (price: SqlType) (name: ColumnConstraint list) =
+    { emptySchema with
+        tables =
+          [ table
+              "table0"
+              [ column "code" code [ NotNull ]
+                column "price" price [ NotNull ]
+                column "name" SqlText name ]
+              [] ] }
+
+  let p =
+    { emptyProject with
+        source = withColumns SqlText SqlInteger [ NotNull; Default(String "") ] }
+
+  let r = migration (withColumns SqlInteger SqlReal [ Default(String "") ]) p
+
+  let expected: list<SolverProposal> option =
+    Some
+      [ { reason =
+            Changed(
+              "code integer NOT NULL, price real NOT NULL, name text DEFAULT ''",
+              "code text NOT NULL, price integer NOT NULL, name text NOT NULL DEFAULT ''"
+            )
+          statements =
+            [ "CREATE TABLE table0_aux(code text NOT NULL, price integer NOT NULL, name text NOT NULL DEFAULT '')"
+              "INSERT OR IGNORE INTO table0_aux(code, price, name) SELECT CAST(code AS TEXT), CAST(ROUND(price) AS INTEGER), COALESCE(name, '') FROM table0"
+              "DROP TABLE table0"
+              "ALTER TABLE table0_aux RENAME TO table0" ]
+          rebuilds = Some "table0"
+          warning = None
+          destructive = true } ]
+
+  Assert.Equal(expected, r)
+
+[<Fact>]
+let copyColumnExpressions () =
+  let withColumns (xs: ColumnDef list) =
+    { emptySchema with
+        tables = [ table "person" (column "id" SqlInteger [ NotNull ] :: xs) [] ] }
+
+  let p =
+    { emptyProject with
+        source =
+          withColumns
+            [ column "first_name" SqlText [ NotNull; Default(String "") ]
+              column "last_name" SqlText [ Default(String "") ] ] }
+
+  let copyColumns =
+    Map [ "person", Map [ "first_name", "substr(full_name, 1, instr(full_name, ' ') - 1)" ] ]
+
+  let r =
+    columnsMigrationWith false copyColumns (withColumns [ column "full_name" SqlText [ NotNull ] ]) p
+
+  let expected: list<SolverProposal> =
+    [ { reason =
+          Changed(
+            "id integer NOT NULL, full_name text NOT NULL",
+            "id integer NOT NULL, first_name text NOT NULL DEFAULT '', last_name text DEFAULT ''"
+          )
+        statements =
+          [ "CREATE TABLE person_aux(id integer NOT NULL, first_name text NOT NULL DEFAULT '', last_name text DEFAULT '')"
+            "INSERT OR IGNORE INTO person_aux(id, first_name, last_name) SELECT id, substr(full_name, 1, instr(full_name, ' ') - 1), '' FROM person"
+            "DROP TABLE person"
+            "ALTER TABLE person_aux RENAME TO person" ]
+        rebuilds = Some "person"
+        warning = None
+        destructive = true } ]
+
+  Assert.Equal<SolverProposal list>(expected, r)
+
+[<Fact>]
+let changeVirtualTableArgs () =
+  let docs args =
+    { emptySchema with
+        virtualTables =
+          [ { name = "docs"
+              moduleName = "fts5"
+              moduleArgs = args } ] }
+
+  let p =
+    { emptyProject with
+        source = docs [ "title"; "body" ] }
+
+  let r = migration (docs [ "title" ]) p
+
+  let expected: list<SolverProposal> option =
+    Some
+      [ { reason = Removed "docs"
+          statements = [ "DROP TABLE docs" ]
+          rebuilds = None
+          warning = None
+          destructive = true }
+        { reason = Added "docs"
+          statements = [ "CREATE VIRTUAL TABLE docs USING fts5(title, body)" ]
+          rebuilds = None
+          warning = None
+          destructive = false } ]
+
+  Assert.Equal(expected, r)
+
+[<Fact>]
+let unindexedForeignKeys () =
+  let foreignKey columns =
+    ForeignKey
+      { columns = columns
+        refTable = "table0"
+        refColumns = []
+        onDelete = None
+        onUpdate = None
+        deferred = false }
+
+  let column name constraints = Util.column name SqlInteger constraints
+
+  let table1 =
+    table
+      "table1"
+      [ column "id" [ PrimaryKey [] ]; column "a" [ foreignKey [] ]; column "b" []; column "c" [] ]
+      [ foreignKey [ "b"; "c" ]; foreignKey [ "id" ] ]
+
+  let index columns =
+    { name = "index0"
+      table = "table1"
+      columns = columns
+      where = None
+      unique = false }
+
+  let schema (indexes: CreateIndex list) =
+    { emptySchema with
+        tables = (schemaWithOneTable "table0").tables @ [ table1 ]
+        indexes = indexes }
+
+  Assert.Equal<LintWarning list>(
+    [ UnindexedForeignKey("table1", [ "b"; "c" ]); UnindexedForeignKey("table1", [ "a" ]) ],
+    Migrate.Checks.Lint.lint (schema [])
+  )
+
+  Assert.Equal<LintWarning list>(
+    [ UnindexedForeignKey("table1", [ "a" ]) ],
+    Migrate.Checks.Lint.lint (schema [ index [ "c DESC"; "b"; "a" ] ])
+  )
+
+[<Fact>]
+let redundantIndexes () =
+  let index name columns =
+    { name = name
+      table = "table0"
+      columns = columns
+      where = None
+      unique = false }
+
+  let schema =
+    { emptySchema with
+        tables = (schemaWithOneTable "table0").tables
+        indexes =
+          [ index "index_a" [ "a" ]
+            index "index_ab" [ "a"; "b" ]
+            index "index_ba" [ "b"; "a" ]
+            { index "index_c" [ "c" ] with
+                where = Some "c IS NOT NULL" }
+            index "index_cd" [ "c"; "d" ] ] }
+
+  Assert.Equal<LintWarning list>([ RedundantIndex("index_a", "index_ab") ], Migrate.Checks.Lint.lint schema)
@@ -106,7 +106,9 @@ let wrapWithProject () =
             values = [ [ Integer 0; String "value0" ] ] } ]
       tables = []
       views = []
-      indexes = [] }
+      indexes = []
+      virtualTables = []
+      triggers = [] }
 
   let expected: Project =
     { versionRemarks = "project initialization"
@@ -124,3 +126,28 @@ let wrapWithProject () =
   let f = mergeTomlSql p src
 
   Assert.Equal(expected, f)
+
+[<Fact>]
+let reportAllMalformedFiles () =
+  let p =
+    { versionRemarks = "project initialization"
+      schemaVersion = "0.0.1"
+      dbFile = "/data/db.sqlite3"
+      syncs = []
+      files = [ "file0.sql"; "file1.sql"; "file2.sql" ]
+      pullScript = None
+      reports = [] }
+
+  let reader file =
+    match file with
+    | "file1.sql" -> file, "CREATE TABLE table0(id integer NOT NULL);"
+    | _ -> file, "CREATE TABLE ("
+
+  try
+    buildProject reader p |> ignore
+    failwith "it should throw an exception because file0.sql and file2.sql are malformed"
+  with MalformedProject e ->
+    let errors = e.Split '\n'
+    Assert.Equal(2, errors.Length)
+    Assert.StartsWith("Error parsing file0.sql", errors[0])
+    Assert.StartsWith("Error parsing file2.sql", errors[1])
@@ -17,12 +17,15 @@ module RunMigration
 open Xunit
 open Migrate
 open Types
+open Util
 
 let emptySchema =
   { inserts = []
     tables = []
     views = []
-    indexes = [] }
+    indexes = []
+    virtualTables = []
+    triggers = [] }
 
 let emptyProject: Project =
   { dbFile = "test.sqlite3"
@@ -36,58 +39,665 @@ let emptyProject: Project =
 let schema0 =
   { emptySchema with
       tables =
-        [ { name = "table0"
-            columns =
-              [ { name = "col0"
-                  columnType = SqlInteger
-                  constraints = [ NotNull ] } ]
-            constraints = [] } ] }
-
-let removeFile f =
-  if System.IO.File.Exists f then
-    System.IO.File.Delete f
-  else
-    ()
+        [ table "table0" [ column "col0" SqlInteger [ NotNull ] ] [] ] }
 
 [<Fact>]
 let stepCalcTest () =
-  let dbFile = emptyProject.dbFile
-  let tempDb = Execution.Commit.createTempDb emptyProject.source dbFile
-  let p = { emptyProject with dbFile = tempDb }
+  Execution.Commit.withTempDb schema0 emptyProject.dbFile (fun tempDb ->
+    use conn = DbUtil.openConn tempDb
+    let p = { emptyProject with dbFile = tempDb }
 
-  Execution.Commit.replicateInDb schema0 p.dbFile
+    match Execution.Commit.migrateStep p conn with
+    | Some [ { reason = Removed "table0"
+               statements = xs
+               error = None
+               rebuilds = None
+               warning = None
+               destructive = true } ] -> Assert.Equal<string list>([ "DROP TABLE table0" ], xs)
+    | Some [ { statements = xs; error = Some e } ] -> Assert.Fail($"executing {xs} got error {e}")
+    | None -> Assert.Fail "expected sql, got none"
+    | v -> Assert.Fail $"got {v} instead the expected pattern")
 
-  let run () =
-    use conn = DbUtil.openConn p.dbFile
-    let r = Execution.Commit.migrateStep p conn
-    removeFile "test.sqlite3"
-    r
+[<Fact>]
+let failedStepRollbackTest () =
+  // renaming the rebuilt table fails because view0 selects from the dropped one,
+  // after the rows were copied to table0_aux
+  let current =
+    { schema0 with
+        views =
+          [ { name = "view0"
+              selectUnion = "SELECT col0 FROM table0"
+              columns = []
+              temporary = false } ] }
+
+  let desired =
+    { current with
+        tables = [ table "table0" [ column "col0" SqlInteger [] ] [] ] }
+
+  Execution.Commit.withTempDb current emptyProject.dbFile (fun tempDb ->
+    use conn = DbUtil.openConn tempDb
+    let p = { emptyProject with dbFile = tempDb; source = desired }
+
+    match Execution.Commit.migrateStep p conn with
+    | Some [ { error = Some e } ] -> Assert.Contains("view0", e)
+    | v -> Assert.Fail $"expecting a failed step, got {v}"
+
+    let schema = DbProject.LoadDbSchema.dbSchema p conn
+    let sqlTables (f: SqlFile) = f.tables |> List.collect SqlGeneration.Table.sqlCreateTable
+    Assert.Equal<string list>(sqlTables current, sqlTables schema))
+
+[<Fact>]
+let addNotNullKeepsNullRowsTest () =
+  let withName constraints =
+    { emptySchema with
+        tables = [ table "table0" [ column "id" SqlInteger [ PrimaryKey [] ]; column "name" SqlText constraints ] [] ] }
+
+  let current = withName []
+  let desired = withName [ NotNull ]
+
+  Execution.Commit.withTempDb current emptyProject.dbFile (fun tempDb ->
+    use conn = DbUtil.openConn tempDb
+    DbUtil.runSql conn "INSERT INTO table0(id, name) VALUES (1, 'a'), (2, NULL)"
+    let p = { emptyProject with dbFile = tempDb; source = desired }
+
+    // without a value for the nulls the copy fails, keeping the table and its rows
+    match Execution.Commit.migrateStep p conn with
+    | Some [ { error = Some e } ] -> Assert.Contains("NOT NULL", e)
+    | v -> Assert.Fail $"expecting a failed step, got {v}"
+
+    let count (sql: string) =
+      use c = conn.CreateCommand()
+      c.CommandText <- sql
+      c.ExecuteScalar() :?> int64
+
+    Assert.Equal(2L, count "SELECT count(*) FROM table0")
+    Assert.Equal(0L, count "SELECT count(*) FROM sqlite_master WHERE name = 'table0_aux'")
+
+    let copyColumns = Map [ "table0", Map [ "name", "COALESCE(name, 'unknown')" ] ]
+
+    match Execution.Commit.migrateStepWith false copyColumns p conn with
+    | Some steps -> Assert.True(steps |> List.forall _.error.IsNone, $"{steps}")
+    | None -> Assert.Fail "expecting a migration step"
+
+    let rows = DbProject.LoadDbSchema.tableValues conn desired.tables.Head
+    Assert.Equal<Expr list list>([ [ Integer 1; String "a" ]; [ Integer 2; String "unknown" ] ], rows.values))
+
+[<Fact>]
+let dropNotNullTest () =
+  let withName constraints =
+    { emptySchema with
+        tables = [ table "table0" [ column "id" SqlInteger [ PrimaryKey [] ]; column "name" SqlText constraints ] [] ]
+        inserts =
+          [ { table = "table0"
+              columns = [ "id"; "name" ]
+              values = [ [ Integer 1; String "a" ]; [ Integer 2; String "b" ] ] } ] }
+
+  let current = withName [ NotNull ]
+  let desired = withName []
 
-  match run () with
-  | Some [ { reason = Removed "table0"
-             statements = xs
-             error = None } ] -> Assert.Equal<string list>([ "DROP TABLE table0" ], xs)
-  | Some [ { statements = xs; error = Some e } ] -> Assert.Fail($"executing {xs} got error {e}")
-  | None -> Assert.Fail "expected sql, got none"
-  | v -> Assert.Fail $"got {v} instead the expected pattern"
+  Execution.Commit.withTempDb current emptyProject.dbFile (fun tempDb ->
+    use conn = DbUtil.openConn tempDb
+    let p = { emptyProject with dbFile = tempDb; source = desired }
+
+    // the column keeps NOT NULL unless the table is rebuilt, which copies every row
+    match Execution.Commit.migrateStep p conn with
+    | Some steps ->
+      Assert.True(steps |> List.forall _.error.IsNone, $"{steps}")
+      Assert.Contains("ALTER TABLE table0_aux RENAME TO table0", steps |> List.collect _.statements)
+    | None -> Assert.Fail "expecting a migration step"
+
+    let rows = DbProject.LoadDbSchema.tableValues conn desired.tables.Head
+    Assert.Equal<Expr list list>(current.inserts.Head.values, rows.values))
+
+[<Fact>]
+let blobValuesTest () =
+  let blobs =
+    { emptySchema with
+        tables = [ table "table0" [ column "id" SqlInteger [ NotNull ]; column "content" SqlBlob [] ] [] ]
+        inserts =
+          [ { table = "table0"
+              columns = [ "id"; "content" ]
+              values = [ [ Integer 1; Blob [| 0xCAuy; 0xFEuy |] ] ] } ] }
+
+  Execution.Commit.withTempDb blobs emptyProject.dbFile (fun tempDb ->
+    use conn = DbUtil.openConn tempDb
+    let values = DbProject.LoadDbSchema.tableValues conn blobs.tables.Head
+    Assert.Equal<Expr list list>(blobs.inserts.Head.values, values.values))
+
+[<Fact>]
+let realAndNumericValuesTest () =
+  let numbers =
+    { emptySchema with
+        tables =
+          [ table
+              "table0"
+              [ column "price" SqlReal [ NotNull ]; column "amount" (SqlNumeric "DECIMAL(10,2)") [ NotNull ] ]
+              [] ]
+        inserts =
+          [ { table = "table0"
+              columns = [ "price"; "amount" ]
+              values = [ [ Real 0.5; Integer 3 ]; [ Real 2.0; Real 1.25 ]; [ Real 1.5; String "n/a" ] ] } ] }
+
+  Execution.Commit.withTempDb numbers emptyProject.dbFile (fun tempDb ->
+    use conn = DbUtil.openConn tempDb
+    let values = DbProject.LoadDbSchema.tableValues conn numbers.tables.Head
+    Assert.Equal<Expr list list>(numbers.inserts.Head.values, values.values))
 
 [<Fact>]
 let runMigrationTest () =
-  Execution.Commit.dryMigration emptyProject
+  Execution.Commit.withTempDb emptySchema emptyProject.dbFile (fun tempDb ->
+    Execution.Commit.dryMigration { emptyProject with dbFile = tempDb })
 
 [<Fact>]
 let getMigrationsTest () =
-  let tempDb = Execution.Commit.createTempDb emptyProject.source emptyProject.dbFile
-  let p0 = { emptyProject with dbFile = tempDb }
-
-  let p =
-    { p0 with
-        source = schema0
-        schemaVersion = "0.0.1" }
-
-  Execution.Commit.migrateAndCommit p
-  use conn = DbUtil.openConn p.dbFile
-  let xs = Migrate.Execution.Store.Get.getMigrations conn
-  removeFile p0.dbFile
-  Assert.Equal(1, xs.Length)
-  Assert.Equal("empty project", xs.Head.migration.versionRemarks)
+  Execution.Commit.withTempDb emptySchema emptyProject.dbFile (fun tempDb ->
+    let p =
+      { emptyProject with
+          dbFile = tempDb
+          source = schema0
+          schemaVersion = "0.0.1" }
+
+    Execution.Commit.migrateAndCommit p
+    use conn = DbUtil.openConn p.dbFile
+    let xs = Migrate.Execution.Store.Get.getMigrations conn
+    Assert.Equal(1, xs.Length)
+    Assert.Equal("empty project", xs.Head.migration.versionRemarks))
+
+[<Fact>]
+let manualMigrationAnnotatedTest () =
+  let source =
+    match
+      Migrate.SqlParser.parseSql
+        "manualMigrationAnnotatedTest"
+        "-- @renamed-from table0\nCREATE TABLE table1(col0 integer NOT NULL);"
+    with
+    | Ok f -> f
+    | Error e -> failwith e
+
+  Execution.Commit.withTempDb schema0 emptyProject.dbFile (fun tempDb ->
+    use conn = DbUtil.openConn tempDb
+    let p = { emptyProject with dbFile = tempDb; source = source }
+    // the database doesn't keep the annotation, which must not make the schemas differ
+    Execution.Commit.execManualMigration p conn "ALTER TABLE table0 RENAME TO table1"
+    let xs = Migrate.Execution.Store.Get.getMigrations conn
+    Assert.Equal(1, xs.Length))
+
+[<Fact>]
+let migrationSqlTest () =
+  let desired =
+    "CREATE TABLE table0(id integer NOT NULL);
+     CREATE TABLE table1(id integer NOT NULL, name text NOT NULL);"
+
+  match Cli.migrationSql "" desired with
+  | Ok xs ->
+    let expected =
+      [ "CREATE TABLE table0(id integer NOT NULL)"
+        "CREATE TABLE table1(id integer NOT NULL, name text NOT NULL)" ]
+
+    Assert.Equal<string list>(expected, xs)
+  | Error e -> Assert.Fail e
+
+[<Fact>]
+let migrationSqlCurrentTimestampTest () =
+  let desired =
+    "CREATE TABLE table0(id integer PRIMARY KEY, created text NOT NULL DEFAULT CURRENT_TIMESTAMP);"
+
+  match Cli.migrationSql "" desired with
+  | Ok xs -> Assert.Contains("DEFAULT CURRENT_TIMESTAMP", String.concat "\n" xs)
+  | Error e -> Assert.Fail e
+
+  match Cli.migrationSql desired desired with
+  | Ok xs -> Assert.Empty xs
+  | Error e -> Assert.Fail e
+
+[<Fact>]
+let migrationSqlInvalidCurrentTest () =
+  let current = "CREATE TABLE table0(id integer NOT NULL CHECK (missing > 0));"
+
+  match Cli.migrationSql current "" with
+  | Ok xs -> Assert.Fail $"expecting an error, got {xs}"
+  | Error e ->
+    Assert.StartsWith("Replicating the current schema", e)
+    Assert.Contains("no such column", e)
+
+[<Fact>]
+let migrationSqlInvalidStatementTest () =
+  let desired = "CREATE TABLE table0(id integer NOT NULL CHECK (missing > 0));"
+
+  match Cli.migrationSql "" desired with
+  | Ok xs -> Assert.Fail $"expecting an error, got {xs}"
+  | Error e ->
+    Assert.StartsWith("CREATE TABLE table0", e)
+    Assert.Contains("no such column", e)
+
+[<Fact>]
+let columnCommentsRoundTripTest () =
+  let schema =
+    "CREATE TABLE table0(
+       id integer PRIMARY KEY, -- row identifier
+       name text NOT NULL -- shown in lists
+     );"
+
+  match Cli.migrationSql "" schema with
+  | Ok xs -> Assert.Contains("-- shown in lists", String.concat "\n" xs)
+  | Error e -> Assert.Fail e
+
+  // the comments are read back from the database, so there is nothing to migrate
+  match Cli.migrationSql schema schema with
+  | Ok xs -> Assert.Empty xs
+  | Error e -> Assert.Fail e
+
+[<Fact>]
+let migrationSqlMissingDependenciesTest () =
+  match Cli.migrationSql "" "CREATE VIEW view0 AS SELECT * FROM missing;" with
+  | Ok xs -> Assert.Fail $"expecting an error, got {xs}"
+  | Error e -> Assert.Contains("missing", e)
+
+[<Fact>]
+let migrationSqlDependencyCycleTest () =
+  let desired =
+    "CREATE VIEW view0 AS SELECT * FROM view1;
+     CREATE VIEW view1 AS SELECT * FROM view0;"
+
+  match Cli.migrationSql "" desired with
+  | Ok xs -> Assert.Fail $"expecting an error, got {xs}"
+  | Error e -> Assert.Contains("view0", e)
+
+[<Fact>]
+let renameColumnInViewTest () =
+  let current =
+    "CREATE TABLE table0(id integer NOT NULL, name text NOT NULL);
+     CREATE VIEW view0 AS SELECT name FROM table0;"
+
+  let desired =
+    "CREATE TABLE table0(id integer NOT NULL, title text NOT NULL);
+     CREATE VIEW view0 AS SELECT title FROM table0;"
+
+  match Cli.migrationSql current desired with
+  | Ok xs -> Assert.Equal<string list>([ "ALTER TABLE table0 RENAME COLUMN name TO title" ], xs)
+  | Error e -> Assert.Fail e
+
+[<Fact>]
+let noOpMigrationTest () =
+  let schema =
+    "CREATE TABLE table0(id integer PRIMARY KEY, name text NOT NULL UNIQUE);
+     CREATE TABLE table1(id integer NOT NULL, t0 integer REFERENCES table0(id), CHECK (id > 0));
+     CREATE VIEW view0 AS SELECT t.name FROM table0 t JOIN table1 ON table1.t0 = t.id;
+     CREATE UNIQUE INDEX index0 ON table1(t0) WHERE t0 IS NOT NULL;
+     INSERT INTO table0(id, name) VALUES (1, 'a'), (2, 'b');"
+
+  match Cli.migrationSql schema schema with
+  | Ok xs -> Assert.Empty xs
+  | Error e -> Assert.Fail e
+
+[<Fact>]
+let virtualTableMigrationTest () =
+  let desired = "CREATE VIRTUAL TABLE docs USING fts5(title, body);"
+
+  match Cli.migrationSql "" desired, Cli.migrationSql desired desired with
+  | Ok xs, Ok ys ->
+    Assert.Equal<string list>([ "CREATE VIRTUAL TABLE docs USING fts5(title, body)" ], xs)
+    Assert.Empty ys
+  | Error e, _
+  | _, Error e -> Assert.Fail e
+
+[<Fact>]
+let shadowTablesTest () =
+  let current =
+    "CREATE TABLE table0(id integer NOT NULL);
+     CREATE VIRTUAL TABLE docs USING fts5(title, body);"
+
+  let tempDb =
+    match Migrate.SqlParser.parseSql "shadowTablesTest" current with
+    | Ok f -> Execution.Commit.createTempDb f "shadow.sqlite3"
+    | Error e -> failwith e
+
+  use conn = DbUtil.openConn tempDb
+  let schema = DbProject.LoadDbSchema.dbSchema { emptyProject with dbFile = tempDb } conn
+  Assert.Equal<string list>([ "table0" ], schema.tables |> List.map _.name)
+  Assert.Equal<string list>([ "docs" ], schema.virtualTables |> List.map _.name)
+
+  match Cli.migrationSql current "CREATE TABLE table0(id integer NOT NULL);" with
+  | Ok xs -> Assert.Equal<string list>([ "DROP TABLE docs" ], xs)
+  | Error e -> Assert.Fail e
+
+[<Fact>]
+let shadowTablesByNameTest () =
+  // SQLite before 3.37 lacks pragma_table_list, shadow tables are recognized by their names
+  let row name sql : DbProject.LoadDbSchema.SqliteMaster = { name = name; sql = sql }
+
+  let rows =
+    [ row "table0" "CREATE TABLE table0(id integer NOT NULL)"
+      row "docs" "CREATE VIRTUAL TABLE docs USING fts5(title, body)"
+      row "docs_data" "CREATE TABLE 'docs_data'(id INTEGER PRIMARY KEY, block BLOB)"
+      row "docs_config" "CREATE TABLE 'docs_config'(k PRIMARY KEY, v) WITHOUT ROWID"
+      row "documents" "CREATE TABLE documents(id integer NOT NULL)" ]
+
+  let expected = set [ "docs_config"; "docs_data" ]
+  Assert.Equal<Set<string>>(expected, DbProject.LoadDbSchema.shadowTablesByName rows)
+
+[<Fact>]
+let convergeFromPartialSchemaTest () =
+  let partial =
+    "CREATE TABLE table0(id integer PRIMARY KEY, name text NOT NULL);
+     CREATE VIEW view0 AS SELECT name FROM table0;"
+
+  let full =
+    "CREATE TABLE table0(id integer PRIMARY KEY, name text NOT NULL);
+     CREATE TABLE table1(id integer PRIMARY KEY, t0 integer REFERENCES table0(id));
+     CREATE VIEW view0 AS SELECT name FROM table0;
+     CREATE INDEX index0 ON table1(t0);"
+
+  match Cli.migrationSql partial full with
+  | Ok remaining ->
+    Assert.DoesNotContain("CREATE TABLE table0(id integer PRIMARY KEY, name text NOT NULL)", remaining)
+    let applied = partial + (remaining |> List.map (fun s -> s + ";") |> String.concat "\n")
+
+    match Cli.migrationSql applied full with
+    | Ok xs -> Assert.Empty xs
+    | Error e -> Assert.Fail e
+  | Error e -> Assert.Fail e
+
+[<Fact>]
+let migrationSqlIfNotExistsTest () =
+  let desired =
+    "CREATE TABLE table0(id integer NOT NULL);
+     CREATE VIRTUAL TABLE docs USING fts5(title, body);
+     CREATE VIEW view0 AS SELECT id FROM table0;
+     CREATE INDEX index0 ON table0(id);"
+
+  let options =
+    { Cli.defaultMigrationOptions with
+        ifNotExists = true }
+
+  match Cli.migrationSqlWithOptions options "" desired with
+  | Ok xs ->
+    let creates = xs |> List.filter _.StartsWith("CREATE")
+    Assert.Equal(4, creates.Length)
+    Assert.All(creates, (fun x -> Assert.Contains(" IF NOT EXISTS ", x)))
+  | Error e -> Assert.Fail e
+
+[<Fact>]
+let migrationSqlIfNotExistsRebuildTest () =
+  let current = "CREATE TABLE table0(id integer);"
+  let desired = "CREATE TABLE table0(id integer NOT NULL);"
+
+  let expected =
+    [ "DROP TABLE IF EXISTS table0_aux"
+      "CREATE TABLE table0_aux(id integer NOT NULL)"
+      "INSERT OR IGNORE INTO table0_aux(id) SELECT id FROM table0"
+      "DROP TABLE table0"
+      "ALTER TABLE table0_aux RENAME TO table0" ]
+
+  let options =
+    { Cli.defaultMigrationOptions with
+        ifNotExists = true }
+
+  match Cli.migrationSqlWithOptions options current desired with
+  | Ok xs -> Assert.Equal<string list>(expected, xs)
+  | Error e -> Assert.Fail e
+
+[<Fact>]
+let migrationSqlTransactionTest () =
+  let desired = "CREATE TABLE table0(id integer NOT NULL);"
+
+  let options =
+    { Cli.defaultMigrationOptions with
+        transaction = true }
+
+  match Cli.migrationSqlWithOptions options "" desired with
+  | Ok xs ->
+    let expected =
+      [ "BEGIN TRANSACTION"; "CREATE TABLE table0(id integer NOT NULL)"; "COMMIT" ]
+
+    Assert.Equal<string list>(expected, xs)
+  | Error e -> Assert.Fail e
+
+[<Fact>]
+let migrationSqlAnalyzeTest () =
+  let table0 = "CREATE TABLE table0(id integer NOT NULL);"
+  let withIndex = table0 + "CREATE INDEX index0 ON table0(id);"
+
+  let options =
+    { Cli.defaultMigrationOptions with
+        analyze = true }
+
+  match
+    Cli.migrationSqlWithOptions options table0 withIndex,
+    Cli.migrationSqlWithOptions options "" table0,
+    Cli.migrationSql table0 withIndex
+  with
+  | Ok indexed, Ok notIndexed, Ok withoutOption ->
+    Assert.Equal<string list>([ "CREATE INDEX index0 ON table0(id)"; "ANALYZE" ], indexed)
+    Assert.DoesNotContain("ANALYZE", notIndexed)
+    Assert.DoesNotContain("ANALYZE", withoutOption)
+  | Error e, _, _
+  | _, Error e, _
+  | _, _, Error e -> Assert.Fail e
+
+[<Fact>]
+let formatSqlTest () =
+  let statements =
+    [ "CREATE TABLE table0(id integer PRIMARY KEY, name text NOT NULL)"
+      "CREATE INDEX index0 ON table0(name)" ]
+
+  let expected =
+    "CREATE TABLE table0(
+  id   integer PRIMARY KEY,
+  name text    NOT NULL
+);
+CREATE INDEX index0 ON table0(name);"
+
+  Assert.Equal(expected, Cli.formatSql statements)
+
+[<Fact>]
+let migrationPlanTest () =
+  let current = "CREATE TABLE table0(id integer NOT NULL);"
+
+  let desired =
+    "CREATE TABLE table1(id integer NOT NULL, name text NOT NULL);
+     CREATE VIEW view0 AS SELECT name FROM table1;"
+
+  match Cli.migrationPlan current desired with
+  | Ok plan ->
+    Assert.Equal<Diff list>([ Removed "table0"; Added "table1"; Added "view0" ], plan.steps |> List.map _.reason)
+
+    let options =
+      { Cli.defaultMigrationOptions with
+          transaction = true }
+
+    let statements = Cli.renderMigrationPlan options plan
+    Assert.Equal("BEGIN TRANSACTION", statements.Head)
+    Assert.Equal("COMMIT", List.last statements)
+    Assert.Equal<string list>(plan.steps |> List.collect _.statements, statements[1 .. statements.Length - 2])
+  | Error e -> Assert.Fail e
+
+[<Fact>]
+let migrationSqlDefaultOptionsTest () =
+  let desired = "CREATE TABLE table0(id integer NOT NULL);"
+
+  Assert.Equal(Cli.migrationSql "" desired, Cli.migrationSqlWithOptions Cli.defaultMigrationOptions "" desired)
+
+[<Fact>]
+let migrationSqlRebuildRenamedColumnsTest () =
+  let current = "CREATE TABLE table0(id integer NOT NULL, name text NOT NULL);"
+
+  let desired =
+    "CREATE TABLE table0(
+       id integer NOT NULL,
+       -- @renamed-from name
+       title text NOT NULL);"
+
+  let options =
+    { Cli.defaultMigrationOptions with
+        rebuildRenamedColumns = true }
+
+  let expected =
+    [ "CREATE TABLE table0_aux(id integer NOT NULL, title text NOT NULL)"
+      "INSERT OR IGNORE INTO table0_aux(id, title) SELECT id, name FROM table0"
+      "DROP TABLE table0"
+      "ALTER TABLE table0_aux RENAME TO table0" ]
+
+  match Cli.migrationSqlWithOptions options current desired with
+  | Ok xs -> Assert.Equal<string list>(expected, xs)
+  | Error e -> Assert.Fail e
+
+[<Fact>]
+let migrationSqlRebuildTransactionTest () =
+  let table1 = "CREATE TABLE table1(id integer NOT NULL, t0 integer REFERENCES table0(id));"
+  let current = "CREATE TABLE table0(id integer NOT NULL);" + table1
+  let desired = "CREATE TABLE table0(id integer NOT NULL UNIQUE);" + table1
+
+  let options =
+    { Cli.defaultMigrationOptions with
+        transaction = true }
+
+  match Cli.migrationSqlWithOptions options current desired with
+  | Ok xs ->
+    Assert.Equal<string list>([ "PRAGMA foreign_keys=OFF"; "BEGIN TRANSACTION" ], List.take 2 xs)
+    Assert.Equal<string list>([ "COMMIT"; "PRAGMA foreign_keys=ON" ], xs |> List.skip (xs.Length - 2))
+    Assert.Contains("ALTER TABLE table0_aux RENAME TO table0", xs)
+    Assert.Contains("PRAGMA foreign_key_check", xs)
+  | Error e -> Assert.Fail e
+
+[<Fact>]
+let migrationSqlReferencedRebuildTest () =
+  let table1 = "CREATE TABLE table1(id integer NOT NULL, t0 integer REFERENCES table0(id));"
+  let current = "CREATE TABLE table0(id integer NOT NULL);" + table1
+
+  let desired =
+    "CREATE TABLE table0(id integer NOT NULL UNIQUE);
+     CREATE TABLE table2(id integer NOT NULL);"
+    + table1
+
+  let expected =
+    [ "CREATE TABLE table2(id integer NOT NULL)"
+      "PRAGMA foreign_keys=OFF"
+      "CREATE TABLE table0_aux(id integer NOT NULL UNIQUE)"
+      "INSERT OR IGNORE INTO table0_aux(id) SELECT id FROM table0"
+      "DROP TABLE table0"
+      "ALTER TABLE table0_aux RENAME TO table0"
+      "PRAGMA foreign_key_check"
+      "PRAGMA foreign_keys=ON" ]
+
+  match Cli.migrationSqlWithOptions Cli.defaultMigrationOptions current desired with
+  | Ok xs -> Assert.Equal<string list>(expected, xs)
+  | Error e -> Assert.Fail e
+
+[<Fact>]
+let migrationSqlUnreferencedRebuildTest () =
+  let current = "CREATE TABLE table0(id integer NOT NULL);"
+  let desired = "CREATE TABLE table0(id integer NOT NULL UNIQUE);"
+
+  let options =
+    { Cli.defaultMigrationOptions with
+        transaction = true }
+
+  match Cli.migrationSqlWithOptions options current desired with
+  | Ok xs ->
+    Assert.Equal("BEGIN TRANSACTION", xs.Head)
+    Assert.DoesNotContain("PRAGMA foreign_keys=OFF", xs)
+    Assert.Contains("ALTER TABLE table0_aux RENAME TO table0", xs)
+  | Error e -> Assert.Fail e
+
+[<Fact>]
+let migrationSqlDownTest () =
+  let current = "CREATE TABLE table0(id integer NOT NULL);"
+
+  let desired =
+    "CREATE TABLE table0(id integer NOT NULL);
+     CREATE TABLE table1(id integer NOT NULL);"
+
+  match Cli.migrationSql current desired, Cli.migrationSqlDown current desired with
+  | Ok up, Ok down ->
+    Assert.Equal<string list>([ "CREATE TABLE table1(id integer NOT NULL)" ], up)
+    Assert.Equal<string list>([ "DROP TABLE table1" ], down.reverting)
+    Assert.Empty down.irreversible
+  | Error e, _
+  | _, Error e -> Assert.Fail e
+
+[<Fact>]
+let migrationSqlDownIrreversibleTest () =
+  let current = "CREATE TABLE table0(id integer NOT NULL, name text NOT NULL DEFAULT '');"
+  let desired = "CREATE TABLE table0(id integer NOT NULL);"
+
+  match Cli.migrationSqlDown current desired with
+  | Ok down ->
+    Assert.Equal<string list>([ "ALTER TABLE table0 ADD COLUMN name text NOT NULL DEFAULT ''" ], down.reverting)
+    Assert.Equal<string list>([ "ALTER TABLE table0 DROP COLUMN name" ], down.irreversible |> List.map _.sql)
+  | Error e -> Assert.Fail e
+
+[<Fact>]
+let migrationSqlKeywordsTest () =
+  let desired =
+    "CREATE TABLE \"order\"(id integer NOT NULL, \"select\" text NOT NULL);
+     CREATE INDEX index0 ON \"order\"(\"select\");"
+
+  let expected =
+    [ "CREATE TABLE `order`(id integer NOT NULL, `select` text NOT NULL)"
+      "CREATE INDEX index0 ON `order`(`select`)" ]
+
+  let options =
+    { Cli.defaultMigrationOptions with
+        quoteStyle = Backticks }
+
+  match Cli.migrationSqlWithOptions options "" desired with
+  | Ok xs -> Assert.Equal<string list>(expected, xs)
+  | Error e -> Assert.Fail e
+
+[<Fact>]
+let ambiguousRenameWarningTest () =
+  let parse sql =
+    match Migrate.SqlParser.parseSql "ambiguousRenameWarningTest" sql with
+    | Ok f -> f
+    | Error e -> failwith e
+
+  let current = parse "CREATE TABLE table0(id integer NOT NULL);"
+
+  let desired =
+    parse
+      "CREATE TABLE table1(id integer NOT NULL);
+       CREATE TABLE table2(id integer NOT NULL);"
+
+  let warnings =
+    Execution.Commit.migrationProposals false Map.empty current desired |> List.choose _.warning
+
+  Assert.Equal<string list>(
+    [ "table0 matches table1, table2 and the rename is ambiguous, so it's dropped instead of renamed" ],
+    warnings
+  )
+
+[<Fact>]
+let annotatedMigrationSqlTest () =
+  let current = "CREATE TABLE table0(id integer NOT NULL);"
+  let desired = "CREATE TABLE table1(id integer NOT NULL, name text NOT NULL);"
+
+  match Cli.annotatedMigrationSql current desired with
+  | Ok xs ->
+    let flags = xs |> List.map (fun x -> x.sql, x.destructive)
+
+    let expected =
+      [ "DROP TABLE table0", true
+        "CREATE TABLE table1(id integer NOT NULL, name text NOT NULL)", false ]
+
+    Assert.Equal<(string * bool) list>(expected, flags)
+  | Error e -> Assert.Fail e
+
+[<Fact>]
+let migrationSqlTemporaryTest () =
+  let current = "CREATE TABLE table0(id integer NOT NULL);"
+
+  let desired =
+    "CREATE TABLE table0(id integer NOT NULL);
+     CREATE TEMP VIEW view0 AS SELECT id FROM table0;"
+
+  let options =
+    { Cli.defaultMigrationOptions with
+        temporary = true }
+
+  match Cli.migrationSql current desired, Cli.migrationSqlWithOptions options current desired with
+  | Ok persistent, Ok withTemporary ->
+    Assert.Empty persistent
+    Assert.Equal<string list>([ "CREATE TEMP VIEW view0 AS\nSELECT id FROM table0" ], withTemporary)
+  | Error e, _
+  | _, Error e -> Assert.Fail e
@@ -20,6 +20,7 @@ open Types
 open DbUtil
 open Migrate.Reports.Report
 open Dapper.FSharp.SQLite
+open Util
 
 let exampleProject =
   { dbFile = ":memory:"
@@ -30,27 +31,19 @@ let exampleProject =
     pullScript = None
     source =
       { tables =
-          [ { name = "rel0_report"
-              columns =
-                [ { name = "col0"
-                    columnType = SqlInteger
-                    constraints = [ NotNull ] }
-                  { name = "col1"
-                    columnType = SqlText
-                    constraints = [ NotNull ] } ]
-              constraints = [ Unique [ "col0" ] ] }
-            { name = "rel0"
-              columns =
-                [ { name = "col0"
-                    columnType = SqlInteger
-                    constraints = [ NotNull ] }
-                  { name = "col1"
-                    columnType = SqlText
-                    constraints = [ NotNull ] } ]
-              constraints = [ Unique [ "col0" ] ] } ]
+          [ table
+              "rel0_report"
+              [ column "col0" SqlInteger [ NotNull ]; column "col1" SqlText [ NotNull ] ]
+              [ Unique [ "col0" ] ]
+            table
+              "rel0"
+              [ column "col0" SqlInteger [ NotNull ]; column "col1" SqlText [ NotNull ] ]
+              [ Unique [ "col0" ] ] ]
         views = []
         inserts = []
-        indexes = [] } }
+        indexes = []
+        virtualTables = []
+        triggers = [] } }
 
 type Rel0 = { col0: int; col1: string }
 let rel0Table = table'<Rel0> "rel0"
@@ -15,6 +15,7 @@
 module SqlGenerationTest
 
 open Xunit
+open Util
 open Migrate.Types
 
 [<Fact>]
@@ -26,3 +27,169 @@ let SqlInsertIntoTest () =
 
   let xs = Migrate.SqlGeneration.InsertInto.sqlInsertInto i
   Assert.Equal(0, xs.Length)
+
+[<Fact>]
+let SqlInsertIntoBlobTest () =
+  let i =
+    { table = "table0"
+      columns = [ "id"; "content" ]
+      values = [ [ Integer 1; Blob [| 0xCAuy; 0xFEuy |] ] ] }
+
+  let xs = Migrate.SqlGeneration.InsertInto.sqlInsertInto i
+  Assert.Equal<string list>([ "INSERT INTO table0(id, content) VALUES\n(1, X'CAFE')" ], xs)
+
+[<Fact>]
+let SqlCreateTableCompositeKeyTest () =
+  let t =
+    table
+      "table0"
+      [ column "a" SqlInteger [ NotNull ]; column "b" SqlText [ NotNull ] ]
+      [ PrimaryKey [ "a"; "b" ] ]
+
+  let xs = Migrate.SqlGeneration.Table.sqlCreateTable t
+  Assert.Equal<string list>([ "CREATE TABLE table0(a integer NOT NULL, b text NOT NULL, PRIMARY KEY(a, b))" ], xs)
+
+[<Fact>]
+let SqlCreateTableCommentsTest () =
+  let t =
+    { table "table0" [ column "a" SqlInteger [ NotNull ]; column "b" SqlText [] ] [ PrimaryKey [ "a"; "b" ] ] with
+        columnComments = Map [ "a", "first part of the key"; "b", "second part" ] }
+
+  let expected =
+    "CREATE TABLE table0(
+  a integer NOT NULL, -- first part of the key
+  b text, -- second part
+  PRIMARY KEY(a, b)
+)"
+
+  Assert.Equal<string list>([ expected ], Migrate.SqlGeneration.Table.sqlCreateTable t)
+
+[<Fact>]
+let SqlCreateTableFormattedTest () =
+  let t =
+    { table
+        "users"
+        [ column "id" SqlInteger [ PrimaryKey [] ]
+          column "email" SqlText [ NotNull; Unique [] ]
+          column "team_id" SqlInteger [] ]
+        [ ForeignKey
+            { columns = [ "team_id" ]
+              refTable = "teams"
+              refColumns = [ "id" ]
+              onDelete = Some Cascade
+              onUpdate = None
+              deferred = false }
+          Check "length(email) > 3" ] with
+        strict = true }
+
+  let expected =
+    "CREATE TABLE users(
+  id      integer PRIMARY KEY,
+  email   text    NOT NULL UNIQUE,
+  team_id integer,
+  FOREIGN KEY(team_id) REFERENCES teams(id) ON DELETE CASCADE,
+  CHECK(length(email) > 3)
+) STRICT"
+
+  Assert.Equal(expected, Migrate.SqlGeneration.Table.sqlCreateTableFormatted t)
+
+[<Fact>]
+let SqlCreateTableAutoincrementTest () =
+  let t =
+    table "table0" [ column "id" SqlInteger [ PrimaryKey []; Autoincrement ] ] []
+
+  let xs = Migrate.SqlGeneration.Table.sqlCreateTable t
+  Assert.Equal<string list>([ "CREATE TABLE table0(id integer PRIMARY KEY AUTOINCREMENT)" ], xs)
+
+[<Fact>]
+let SqlCreateTableUniqueTest () =
+  let t =
+    table
+      "table0"
+      [ column "a" SqlInteger [ Unique [] ]; column "b" SqlText [ NotNull ] ]
+      [ Unique [ "a"; "b" ] ]
+
+  let xs = Migrate.SqlGeneration.Table.sqlCreateTable t
+  Assert.Equal<string list>([ "CREATE TABLE table0(a integer UNIQUE, b text NOT NULL, UNIQUE(a, b))" ], xs)
+
+[<Fact>]
+let SqlIfNotExistsTest () =
+  let xs =
+    [ "CREATE TABLE table0(id integer NOT NULL)"
+      "CREATE VIRTUAL TABLE docs USING fts5(title, body)"
+      "CREATE UNIQUE INDEX index0 ON table0(id)"
+      "INSERT INTO table0(id) VALUES (1)" ]
+    |> List.map Migrate.SqlGeneration.Util.sqlIfNotExists
+
+  let expected =
+    [ "CREATE TABLE IF NOT EXISTS table0(id integer NOT NULL)"
+      "CREATE VIRTUAL TABLE IF NOT EXISTS docs USING fts5(title, body)"
+      "CREATE UNIQUE INDEX IF NOT EXISTS index0 ON table0(id)"
+      "INSERT INTO table0(id) VALUES (1)" ]
+
+  Assert.Equal<string list>(expected, xs)
+
+[<Fact>]
+let SqlQuoteIdentTest () =
+  let t =
+    table
+      "order"
+      [ column "select" SqlInteger [ NotNull ]
+        column "full name" SqlText [ NotNull ]
+        column "quote\"d" SqlText [ NotNull ] ]
+      [ Unique [ "select" ] ]
+
+  let xs = Migrate.SqlGeneration.Table.sqlCreateTable t
+
+  let expected =
+    [ "CREATE TABLE \"order\"(\"select\" integer NOT NULL, \"full name\" text NOT NULL, \"quote\"\"d\" text NOT NULL, UNIQUE(\"select\"))" ]
+
+  Assert.Equal<string list>(expected, xs)
+
+  let renamed = Migrate.SqlGeneration.Table.sqlRecreateTable [] t |> List.last
+
+  Assert.Equal("ALTER TABLE order_aux RENAME TO \"order\"", renamed)
+  Assert.Equal("table0", Migrate.SqlGeneration.Util.quoteIdent "table0")
+
+[<Fact>]
+let SqlQuoteIndexColumnsTest () =
+  let index =
+    { name = "index0"
+      table = "order"
+      columns = [ "select"; "id" ]
+      where = None
+      unique = false }
+
+  let xs = Migrate.SqlGeneration.Index.sqlCreateIndex index
+
+  Assert.Equal<string list>([ "CREATE INDEX index0 ON \"order\"(\"select\", id)" ], xs)
+
+[<Fact>]
+let SqlBackticksTest () =
+  let sql =
+    "CREATE TABLE \"order\"(\"select\" integer NOT NULL, \"quote`d\" text NOT NULL DEFAULT 'say \"hi\"')"
+
+  let expected =
+    "CREATE TABLE `order`(`select` integer NOT NULL, `quote``d` text NOT NULL DEFAULT 'say \"hi\"')"
+
+  Assert.Equal(expected, Migrate.SqlGeneration.Util.sqlBackticks sql)
+
+[<Fact>]
+let SqlRecreateTableColumnOrderTest () =
+  let t =
+    table
+      "table0"
+      [ column "zeta" SqlText [ NotNull ]
+        column "alpha" SqlText [ NotNull ]
+        column "mu" SqlText [ NotNull ] ]
+      [ Unique [ "alpha" ] ]
+
+  let xs = Migrate.SqlGeneration.Table.sqlRecreateTable [] t
+
+  let expected =
+    [ "CREATE TABLE table0_aux(zeta text NOT NULL, alpha text NOT NULL, mu text NOT NULL, UNIQUE(alpha))"
+      "INSERT OR IGNORE INTO table0_aux(zeta, alpha, mu) SELECT zeta, alpha, mu FROM table0"
+      "DROP TABLE table0"
+      "ALTER TABLE table0_aux RENAME TO table0" ]
+
+  Assert.Equal<string list>(expected, xs)
@@ -15,6 +15,8 @@
 module SqlParser
 
 open Xunit
+open Util
+open Migrate.Types
 
 [<Fact>]
 let parseInsert () =
@@ -74,3 +76,763 @@ VALUES ('value0'),
 
   let r = Migrate.SqlParser.parseSql "parseInsert" sql
   r |> Result.isOk |> Assert.True
+
+[<Fact>]
+let parseCreateTable () =
+  let sql = "CREATE TABLE table0(id integer, name text);"
+
+  let r = Migrate.SqlParser.parseSql "parseCreateTable" sql
+
+  let expected: CreateTable list =
+    [ table
+        "table0"
+        [ { column "id" SqlInteger [] with
+              declaredType = Some "integer" }
+          { column "name" SqlText [] with
+              declaredType = Some "text" } ]
+        [] ]
+
+  match r with
+  | Ok f -> Assert.Equal<CreateTable list>(expected, f.tables)
+  | Error e -> Assert.Fail e
+
+[<Fact>]
+let parseMalformed () =
+  let r = Migrate.SqlParser.parseSql "parseMalformed" "CREATE TABL foo ("
+
+  match r with
+  | Ok f -> Assert.Fail $"expecting a parsing error, got {f}"
+  | Error e -> Assert.StartsWith("Error parsing parseMalformed(1,", e)
+
+[<Fact>]
+let parseNotNull () =
+  let sql = "CREATE TABLE table0(id integer NOT NULL, name text, age integer NOT NULL);"
+
+  match Migrate.SqlParser.parseSql "parseNotNull" sql with
+  | Ok f ->
+    let constraints = f.tables.Head.columns |> List.map _.constraints
+    Assert.Equal<ColumnConstraint list list>([ [ NotNull ]; []; [ NotNull ] ], constraints)
+  | Error e -> Assert.Fail e
+
+[<Fact>]
+let parsePrimaryKey () =
+  let sql =
+    "
+CREATE TABLE table0(id integer PRIMARY KEY AUTOINCREMENT);
+CREATE TABLE table1(a integer, b text, PRIMARY KEY(a, b));
+  "
+
+  match Migrate.SqlParser.parseSql "parsePrimaryKey" sql with
+  | Ok f ->
+    let table0 = f.tables |> List.find (fun t -> t.name = "table0")
+    let table1 = f.tables |> List.find (fun t -> t.name = "table1")
+    Assert.Equal<ColumnConstraint list>([ PrimaryKey []; Autoincrement ], table0.columns.Head.constraints)
+    Assert.Equal<ColumnConstraint list>([ PrimaryKey [ "a"; "b" ] ], table1.constraints)
+  | Error e -> Assert.Fail e
+
+[<Fact>]
+let parseColumnComments () =
+  let sql =
+    "CREATE TABLE table0(
+       id integer NOT NULL, -- row identifier
+       -- @renamed-from name
+       title text DEFAULT '-- not a comment', -- shown in lists
+       CHECK (id > 0) -- not a column
+     );"
+
+  match Migrate.SqlParser.parseSql "parseColumnComments" sql with
+  | Ok f ->
+    let table0 = f.tables.Head
+    Assert.Equal<Map<string, string>>(Map [ "id", "row identifier"; "title", "shown in lists" ], table0.columnComments)
+
+    // the generated table keeps its comments
+    let generated = Migrate.SqlGeneration.Table.sqlCreateTable table0 |> String.concat ""
+
+    match Migrate.SqlParser.parseSql "generated" generated with
+    | Ok g -> Assert.Equal<Map<string, string>>(table0.columnComments, g.tables.Head.columnComments)
+    | Error e -> Assert.Fail e
+  | Error e -> Assert.Fail e
+
+[<Fact>]
+let parseRenamedColumn () =
+  let sql =
+    "CREATE TABLE table0(
+       id integer NOT NULL,
+       -- @renamed-from name
+       title text);
+     CREATE TABLE table1(id integer NOT NULL);"
+
+  match Migrate.SqlParser.parseSql "parseRenamedColumn" sql with
+  | Ok f ->
+    let renames = f.tables |> List.map (fun t -> t.name, t.renamedColumns) |> List.sort
+
+    Assert.Equal<(string * Map<string, string>) list>(
+      [ "table0", Map [ "title", "name" ]; "table1", Map.empty ],
+      renames
+    )
+  | Error e -> Assert.Fail e
+
+[<Fact>]
+let parseTableAnnotations () =
+  let sql =
+    "-- @id users
+     CREATE TABLE accounts(id integer NOT NULL);
+     -- accounts' emails
+     CREATE TABLE emails(id integer NOT NULL);"
+
+  match Migrate.SqlParser.parseSql "parseTableAnnotations" sql with
+  | Ok f ->
+    let annotations = f.tables |> List.map (fun t -> t.name, t.annotations) |> List.sort
+
+    Assert.Equal<(string * Map<string, string>) list>(
+      [ "accounts", Map [ "id", "users" ]; "emails", Map.empty ],
+      annotations
+    )
+  | Error e -> Assert.Fail e
+
+[<Fact>]
+let parseAnnotationInString () =
+  // the comment is part of the default's literal, not an annotation of the table
+  let sql =
+    "CREATE TABLE table0(id integer NOT NULL);
+     CREATE TABLE users(id integer NOT NULL, note text NOT NULL DEFAULT '-- @renamed-from table0
+     ');"
+
+  match Migrate.SqlParser.parseSql "parseAnnotationInString" sql with
+  | Ok f ->
+    let annotations = f.tables |> List.map (fun t -> t.name, t.annotations) |> List.sort
+
+    Assert.Equal<(string * Map<string, string>) list>(
+      [ "table0", Map.empty; "users", Map.empty ],
+      annotations
+    )
+
+    Assert.True(f.tables |> List.forall (fun t -> t.renamedColumns.IsEmpty))
+  | Error e -> Assert.Fail e
+
+[<Fact>]
+let parseTrigger () =
+  let sql =
+    "CREATE TABLE table0(id integer NOT NULL, total integer NOT NULL);
+     CREATE TRIGGER trigger0 AFTER INSERT ON table0
+     BEGIN
+       UPDATE table0 SET total = CASE WHEN NEW.total < 0 THEN 0 ELSE NEW.total END WHERE id = NEW.id;
+       DELETE FROM table0 WHERE id < 0;
+     END;
+     CREATE VIEW view0 AS SELECT id FROM table0;"
+
+  match Migrate.SqlParser.parseSql "parseTrigger" sql with
+  | Ok f ->
+    Assert.Equal<string list>([ "table0" ], f.tables |> List.map _.name)
+    Assert.Equal<string list>([ "view0" ], f.views |> List.map _.name)
+
+    let trigger = Assert.Single f.triggers
+    Assert.Equal("trigger0", trigger.name)
+    Assert.Equal("table0", trigger.table)
+    Assert.StartsWith("CREATE TRIGGER trigger0 AFTER INSERT ON table0", trigger.sql)
+    Assert.EndsWith("END", trigger.sql)
+  | Error e -> Assert.Fail e
+
+[<Fact>]
+let parseDefault () =
+  let sql = "CREATE TABLE table0(id integer NOT NULL DEFAULT 0, name text DEFAULT 'none');"
+
+  match Migrate.SqlParser.parseSql "parseDefault" sql with
+  | Ok f ->
+    let constraints = f.tables.Head.columns |> List.map _.constraints
+
+    let expected =
+      [ [ NotNull; Default(Integer 0) ]; [ Default(String "none") ] ]
+
+    Assert.Equal<ColumnConstraint list list>(expected, constraints)
+  | Error e -> Assert.Fail e
+
+[<Fact>]
+let parseNonLiteralDefault () =
+  let sql =
+    "CREATE TABLE table0(
+       created text DEFAULT CURRENT_TIMESTAMP,
+       ratio integer DEFAULT 1.5,
+       delta integer DEFAULT -1,
+       total integer DEFAULT (1 + 2));"
+
+  match Migrate.SqlParser.parseSql "parseNonLiteralDefault" sql with
+  | Ok f ->
+    let constraints = f.tables.Head.columns |> List.map _.constraints
+
+    let expected =
+      [ [ DefaultExpr "CURRENT_TIMESTAMP" ]
+        [ Default(Real 1.5) ]
+        [ DefaultExpr "-1" ]
+        [ DefaultExpr "(1 + 2)" ] ]
+
+    Assert.Equal<ColumnConstraint list list>(expected, constraints)
+
+    // the generated table is parsed back to the same one, so its migration converges
+    let generated = Migrate.SqlGeneration.Table.sqlCreateTable f.tables.Head |> String.concat ""
+
+    match Migrate.SqlParser.parseSql "generated" generated with
+    | Ok g -> Assert.Equal<CreateTable list>(f.tables, g.tables)
+    | Error e -> Assert.Fail e
+  | Error e -> Assert.Fail e
+
+[<Fact>]
+let parseUnique () =
+  let sql = "CREATE TABLE table0(a integer UNIQUE, b text, c text, UNIQUE(b, c));"
+
+  match Migrate.SqlParser.parseSql "parseUnique" sql with
+  | Ok f ->
+    let table0 = f.tables.Head
+    Assert.Equal<ColumnConstraint list>([ Unique [] ], table0.columns.Head.constraints)
+    Assert.Equal<ColumnConstraint list>([ Unique [ "b"; "c" ] ], table0.constraints)
+  | Error e -> Assert.Fail e
+
+[<Fact>]
+let parseCheck () =
+  let sql =
+    "CREATE TABLE table0(age integer CHECK (age >= 0), b integer NOT NULL, CHECK (b < age));"
+
+  match Migrate.SqlParser.parseSql "parseCheck" sql with
+  | Ok f ->
+    let table0 = f.tables.Head
+    Assert.Equal<ColumnConstraint list>([ Check "age >= 0" ], table0.columns.Head.constraints)
+    Assert.Equal<ColumnConstraint list>([ Check "b < age" ], table0.constraints)
+
+    let sql = Migrate.SqlGeneration.Table.sqlCreateTable table0
+
+    let expected =
+      [ "CREATE TABLE table0(age integer CHECK(age >= 0), b integer NOT NULL, CHECK(b < age))" ]
+
+    Assert.Equal<string list>(expected, sql)
+  | Error e -> Assert.Fail e
+
+[<Fact>]
+let parseForeignKey () =
+  let sql =
+    "
+CREATE TABLE table1(id integer REFERENCES table0(id));
+CREATE TABLE table2(a integer NOT NULL, b integer NOT NULL, FOREIGN KEY(a, b) REFERENCES table3(c, d));
+  "
+
+  match Migrate.SqlParser.parseSql "parseForeignKey" sql with
+  | Ok f ->
+    let table1 = f.tables |> List.find (fun t -> t.name = "table1")
+    let table2 = f.tables |> List.find (fun t -> t.name = "table2")
+
+    let inline' =
+      ForeignKey
+        { columns = []
+          refTable = "table0"
+          refColumns = [ "id" ]
+          onDelete = None
+          onUpdate = None
+          deferred = false }
+
+    let composite =
+      ForeignKey
+        { columns = [ "a"; "b" ]
+          refTable = "table3"
+          refColumns = [ "c"; "d" ]
+          onDelete = None
+          onUpdate = None
+          deferred = false }
+
+    Assert.Equal<ColumnConstraint list>([ inline' ], table1.columns.Head.constraints)
+    Assert.Equal<ColumnConstraint list>([ composite ], table2.constraints)
+
+    let sql = f.tables |> List.collect Migrate.SqlGeneration.Table.sqlCreateTable |> List.sort
+
+    let expected =
+      [ "CREATE TABLE table1(id integer REFERENCES table0(id))"
+        "CREATE TABLE table2(a integer NOT NULL, b integer NOT NULL, FOREIGN KEY(a, b) REFERENCES table3(c, d))" ]
+
+    Assert.Equal<string list>(expected, sql)
+  | Error e -> Assert.Fail e
+
+[<Fact>]
+let parseForeignKeyActions () =
+  let sql =
+    "
+CREATE TABLE table1(
+  a integer REFERENCES table0(id) ON DELETE CASCADE,
+  b integer REFERENCES table0(id) ON DELETE SET NULL ON UPDATE CASCADE,
+  c integer REFERENCES table0(id));
+  "
+
+  match Migrate.SqlParser.parseSql "parseForeignKeyActions" sql with
+  | Ok f ->
+    let actions =
+      f.tables.Head.columns
+      |> List.collect _.constraints
+      |> List.choose (function
+        | ForeignKey fk -> Some(fk.onDelete, fk.onUpdate)
+        | _ -> None)
+
+    Assert.Equal<(ForeignKeyAction option * ForeignKeyAction option) list>(
+      [ Some Cascade, None; Some SetNull, Some Cascade; None, None ],
+      actions
+    )
+
+    let expected =
+      [ "CREATE TABLE table1(a integer REFERENCES table0(id) ON DELETE CASCADE, "
+        + "b integer REFERENCES table0(id) ON DELETE SET NULL ON UPDATE CASCADE, "
+        + "c integer REFERENCES table0(id))" ]
+
+    Assert.Equal<string list>(expected, Migrate.SqlGeneration.Table.sqlCreateTable f.tables.Head)
+  | Error e -> Assert.Fail e
+
+[<Fact>]
+let parseDeferredForeignKey () =
+  let sql =
+    "CREATE TABLE table1(
+       a integer REFERENCES table0(id) DEFERRABLE INITIALLY DEFERRED,
+       b integer REFERENCES table0(id) DEFERRABLE INITIALLY IMMEDIATE,
+       FOREIGN KEY(a, b) REFERENCES table2(c, d) DEFERRABLE INITIALLY DEFERRED);"
+
+  match Migrate.SqlParser.parseSql "parseDeferredForeignKey" sql with
+  | Ok f ->
+    let deferred =
+      f.tables.Head.constraints @ (f.tables.Head.columns |> List.collect _.constraints)
+      |> List.choose (function
+        | ForeignKey fk -> Some fk.deferred
+        | _ -> None)
+
+    Assert.Equal<bool list>([ true; true; false ], deferred)
+
+    let expected =
+      [ "CREATE TABLE table1(a integer REFERENCES table0(id) DEFERRABLE INITIALLY DEFERRED, "
+        + "b integer REFERENCES table0(id), "
+        + "FOREIGN KEY(a, b) REFERENCES table2(c, d) DEFERRABLE INITIALLY DEFERRED)" ]
+
+    Assert.Equal<string list>(expected, Migrate.SqlGeneration.Table.sqlCreateTable f.tables.Head)
+  | Error e -> Assert.Fail e
+
+[<Fact>]
+let parseIfNotExists () =
+  let withClause =
+    "CREATE TABLE IF NOT EXISTS table0(id integer NOT NULL);
+     CREATE VIEW IF NOT EXISTS view0 AS SELECT id FROM table0;
+     CREATE INDEX IF NOT EXISTS index0 ON table0(id);"
+
+  let withoutClause =
+    "CREATE TABLE table0(id integer NOT NULL);
+     CREATE VIEW view0 AS SELECT id FROM table0;
+     CREATE INDEX index0 ON table0(id);"
+
+  // SQLite doesn't keep the clause in sqlite_master, so it doesn't tell the definitions apart
+  Assert.Equal(
+    Migrate.SqlParser.parseSql "parseIfNotExists" withoutClause,
+    Migrate.SqlParser.parseSql "parseIfNotExists" withClause
+  )
+
+[<Fact>]
+let parseInsertValues () =
+  let sql = "INSERT INTO table0(a, b) VALUES (1, 'x'), (2, 'y');"
+
+  match Migrate.SqlParser.parseSql "parseInsertValues" sql with
+  | Ok f ->
+    let expected =
+      [ { table = "table0"
+          columns = [ "a"; "b" ]
+          values = [ [ Integer 1; String "x" ]; [ Integer 2; String "y" ] ] } ]
+
+    Assert.Equal<InsertInto list>(expected, f.inserts)
+  | Error e -> Assert.Fail e
+
+[<Fact>]
+let parseFile () =
+  let path = System.IO.Path.GetTempFileName()
+  System.IO.File.WriteAllText(path, "CREATE TABLE table0(id integer NOT NULL);")
+
+  let r = Migrate.SqlParser.parseSqlFile path
+  System.IO.File.Delete path
+
+  match r with
+  | Ok f -> Assert.Equal<string list>([ "table0" ], f.tables |> List.map _.name)
+  | Error e -> Assert.Fail e
+
+[<Fact>]
+let parseMissingFile () =
+  let path = System.IO.Path.Combine(System.IO.Path.GetTempPath(), "missing_schema.sql")
+
+  match Migrate.SqlParser.parseSqlFile path with
+  | Ok f -> Assert.Fail $"expecting an error reading {path}, got {f}"
+  | Error e -> Assert.StartsWith($"Error reading {path}", e)
+
+[<Fact>]
+let parseBlob () =
+  let sql =
+    "CREATE TABLE table0(id integer NOT NULL, content blob NOT NULL);
+     INSERT INTO table0(id, content) VALUES (1, X'CAFE');"
+
+  match Migrate.SqlParser.parseSql "parseBlob" sql with
+  | Ok f ->
+    let table0 = f.tables.Head
+    Assert.Equal<SqlType list>([ SqlInteger; SqlBlob ], table0.columns |> List.map _.columnType)
+
+    let expected = [ "CREATE TABLE table0(id integer NOT NULL, content blob NOT NULL)" ]
+    Assert.Equal<string list>(expected, Migrate.SqlGeneration.Table.sqlCreateTable table0)
+
+    let values = f.inserts.Head.values
+    Assert.Equal<Expr list list>([ [ Integer 1; Blob [| 0xCAuy; 0xFEuy |] ] ], values)
+  | Error e -> Assert.Fail e
+
+[<Fact>]
+let parseNumericAffinity () =
+  let sql =
+    "CREATE TABLE table0(price decimal(10,2) NOT NULL, active boolean NOT NULL, day date NOT NULL);"
+
+  match Migrate.SqlParser.parseSql "parseNumericAffinity" sql with
+  | Ok f ->
+    let types = f.tables.Head.columns |> List.map _.columnType
+
+    Assert.Equal<SqlType list>([ SqlNumeric "DECIMAL(10,2)"; SqlNumeric "BOOLEAN"; SqlNumeric "DATE" ], types)
+
+    let expected =
+      [ "CREATE TABLE table0(price DECIMAL(10,2) NOT NULL, active BOOLEAN NOT NULL, day DATE NOT NULL)" ]
+
+    Assert.Equal<string list>(expected, Migrate.SqlGeneration.Table.sqlCreateTable f.tables.Head)
+  | Error e -> Assert.Fail e
+
+[<Fact>]
+let typeAffinity () =
+  let types =
+    [ "BIGINT"; "VARCHAR(255)"; "BLOB"; ""; "DECIMAL(10,2)"; "BOOLEAN"; "DATETIME"; "DOUBLE"; "FLOAT" ]
+    |> List.map Migrate.SqlParser.typeAffinity
+
+  let expected =
+    [ SqlInteger
+      SqlText
+      SqlBlob
+      SqlBlob
+      SqlNumeric "DECIMAL(10,2)"
+      SqlNumeric "BOOLEAN"
+      SqlNumeric "DATETIME"
+      SqlReal
+      SqlReal ]
+
+  Assert.Equal<SqlType list>(expected, types)
+
+[<Fact>]
+let parseReal () =
+  let sql = "CREATE TABLE table0(id integer NOT NULL, price real NOT NULL DEFAULT 0.5);"
+
+  match Migrate.SqlParser.parseSql "parseReal" sql with
+  | Ok f ->
+    let table0 = f.tables.Head
+    Assert.Equal<SqlType list>([ SqlInteger; SqlReal ], table0.columns |> List.map _.columnType)
+
+    let expected =
+      [ "CREATE TABLE table0(id integer NOT NULL, price real NOT NULL DEFAULT 0.5)" ]
+
+    Assert.Equal<string list>(expected, Migrate.SqlGeneration.Table.sqlCreateTable table0)
+  | Error e -> Assert.Fail e
+
+[<Fact>]
+let parseDeclaredType () =
+  let sql =
+    "CREATE TABLE table0(id integer NOT NULL, name VARCHAR(255) NOT NULL, price decimal(10, 2) NOT NULL);"
+
+  match Migrate.SqlParser.parseSql "parseDeclaredType" sql with
+  | Ok f ->
+    let table0 = f.tables.Head
+    let declared = table0.columns |> List.map _.declaredType
+    Assert.Equal<string option list>([ Some "integer"; Some "VARCHAR(255)"; Some "decimal(10, 2)" ], declared)
+
+    let expected =
+      [ "CREATE TABLE table0(id integer NOT NULL, name VARCHAR(255) NOT NULL, price decimal(10, 2) NOT NULL)" ]
+
+    Assert.Equal<string list>(expected, Migrate.SqlGeneration.Table.sqlCreateTable table0)
+  | Error e -> Assert.Fail e
+
+[<Fact>]
+let parseRowidAlias () =
+  // only a single INTEGER PRIMARY KEY column aliases the rowid, the other spellings are kept
+  // so the generated tables don't gain or lose one
+  let sql =
+    "CREATE TABLE table0(id INTEGER PRIMARY KEY, name text NOT NULL);
+     CREATE TABLE table1(id INT PRIMARY KEY, name text NOT NULL);
+     CREATE TABLE table2(id BIGINT NOT NULL, PRIMARY KEY(id));
+     CREATE TABLE table3(a INTEGER NOT NULL, b INTEGER NOT NULL, PRIMARY KEY(a, b));"
+
+  match Migrate.SqlParser.parseSql "parseRowidAlias" sql with
+  | Ok f ->
+    let expected =
+      [ "CREATE TABLE table0(id INTEGER PRIMARY KEY, name text NOT NULL)"
+        "CREATE TABLE table1(id INT PRIMARY KEY, name text NOT NULL)"
+        "CREATE TABLE table2(id BIGINT NOT NULL, PRIMARY KEY(id))"
+        "CREATE TABLE table3(a INTEGER NOT NULL, b INTEGER NOT NULL, PRIMARY KEY(a, b))" ]
+
+    let tables =
+      f.tables
+      |> List.sortBy _.name
+      |> List.collect Migrate.SqlGeneration.Table.sqlCreateTable
+
+    Assert.Equal<string list>(expected, tables)
+  | Error e -> Assert.Fail e
+
+[<Fact>]
+let parseWithoutRowid () =
+  let sql = "CREATE TABLE table0(id integer PRIMARY KEY, name text NOT NULL) WITHOUT ROWID;"
+
+  match Migrate.SqlParser.parseSql "parseWithoutRowid" sql with
+  | Ok f ->
+    let table0 = f.tables.Head
+    Assert.True table0.withoutRowid
+
+    let expected =
+      [ "CREATE TABLE table0(id integer PRIMARY KEY, name text NOT NULL) WITHOUT ROWID" ]
+
+    Assert.Equal<string list>(expected, Migrate.SqlGeneration.Table.sqlCreateTable table0)
+  | Error e -> Assert.Fail e
+
+[<Fact>]
+let parseWithoutRowidNoPrimaryKey () =
+  let sql = "CREATE TABLE table0(id integer NOT NULL) WITHOUT ROWID;"
+
+  match Migrate.SqlParser.parseSql "parseWithoutRowidNoPrimaryKey" sql with
+  | Ok f -> Assert.Fail $"expecting an error, got {f}"
+  | Error e -> Assert.Contains("table0 is WITHOUT ROWID and has no PRIMARY KEY", e)
+
+[<Fact>]
+let parseStrict () =
+  let sql = "CREATE TABLE table0(id integer NOT NULL, name text NOT NULL) STRICT;"
+
+  match Migrate.SqlParser.parseSql "parseStrict" sql with
+  | Ok f ->
+    let table0 = f.tables.Head
+    Assert.True table0.strict
+    Assert.False table0.withoutRowid
+
+    let expected = [ "CREATE TABLE table0(id integer NOT NULL, name text NOT NULL) STRICT" ]
+    Assert.Equal<string list>(expected, Migrate.SqlGeneration.Table.sqlCreateTable table0)
+  | Error e -> Assert.Fail e
+
+[<Fact>]
+let parseWithoutRowidStrict () =
+  let sql =
+    "CREATE TABLE table0(id integer PRIMARY KEY, name text NOT NULL) WITHOUT ROWID, STRICT;"
+
+  match Migrate.SqlParser.parseSql "parseWithoutRowidStrict" sql with
+  | Ok f ->
+    let table0 = f.tables.Head
+    Assert.True(table0.withoutRowid && table0.strict)
+
+    let expected =
+      [ "CREATE TABLE table0(id integer PRIMARY KEY, name text NOT NULL) WITHOUT ROWID, STRICT" ]
+
+    Assert.Equal<string list>(expected, Migrate.SqlGeneration.Table.sqlCreateTable table0)
+  | Error e -> Assert.Fail e
+
+[<Fact>]
+let parseGeneratedColumns () =
+  let sql =
+    "CREATE TABLE table0(price integer NOT NULL, total integer GENERATED ALWAYS AS (price * 2) STORED, half integer AS (price / 2));"
+
+  match Migrate.SqlParser.parseSql "parseGeneratedColumns" sql with
+  | Ok f ->
+    let table0 = f.tables.Head
+
+    let generated =
+      table0.columns
+      |> List.collect _.constraints
+      |> List.filter (function
+        | Generated _ -> true
+        | _ -> false)
+
+    Assert.Equal<ColumnConstraint list>([ Generated("price * 2", Stored); Generated("price / 2", Virtual) ], generated)
+
+    let expected =
+      [ "CREATE TABLE table0(price integer NOT NULL, total integer GENERATED ALWAYS AS (price * 2) STORED, half integer GENERATED ALWAYS AS (price / 2) VIRTUAL)" ]
+
+    Assert.Equal<string list>(expected, Migrate.SqlGeneration.Table.sqlCreateTable table0)
+  | Error e -> Assert.Fail e
+
+[<Fact>]
+let parseCollate () =
+  let sql = "CREATE TABLE table0(id integer NOT NULL, name text COLLATE NOCASE NOT NULL);"
+
+  match Migrate.SqlParser.parseSql "parseCollate" sql with
+  | Ok f ->
+    let table0 = f.tables.Head
+    Assert.Equal<ColumnConstraint list>([ Collate "NOCASE"; NotNull ], table0.columns[1].constraints)
+
+    let expected =
+      [ "CREATE TABLE table0(id integer NOT NULL, name text COLLATE NOCASE NOT NULL)" ]
+
+    Assert.Equal<string list>(expected, Migrate.SqlGeneration.Table.sqlCreateTable table0)
+  | Error e -> Assert.Fail e
+
+[<Fact>]
+let parsePartialIndex () =
+  let sql =
+    "CREATE TABLE table0(id integer NOT NULL, deleted integer NOT NULL);
+     CREATE INDEX index0 ON table0(id) WHERE deleted = 0;"
+
+  match Migrate.SqlParser.parseSql "parsePartialIndex" sql with
+  | Ok f ->
+    let index0 = f.indexes.Head
+    Assert.Equal(Some "deleted = 0", index0.where)
+
+    let expected = [ "CREATE INDEX index0 ON table0(id) WHERE deleted = 0" ]
+    Assert.Equal<string list>(expected, Migrate.SqlGeneration.Index.sqlCreateIndex index0)
+  | Error e -> Assert.Fail e
+
+[<Fact>]
+let parseExpressionIndex () =
+  let sql =
+    "CREATE TABLE table0(id integer NOT NULL, name text NOT NULL);
+     CREATE INDEX index0 ON table0(lower(name), id + 1);"
+
+  match Migrate.SqlParser.parseSql "parseExpressionIndex" sql with
+  | Ok f ->
+    let index0 = f.indexes.Head
+    Assert.Equal<string list>([ "lower(name)"; "id + 1" ], index0.columns)
+
+    let expected = [ "CREATE INDEX index0 ON table0(lower(name), id + 1)" ]
+    Assert.Equal<string list>(expected, Migrate.SqlGeneration.Index.sqlCreateIndex index0)
+  | Error e -> Assert.Fail e
+
+[<Fact>]
+let parseIndexOrderCollation () =
+  let sql =
+    "CREATE TABLE table0(id integer NOT NULL, name text NOT NULL);
+     CREATE INDEX index0 ON table0(id DESC, name COLLATE NOCASE ASC);"
+
+  match Migrate.SqlParser.parseSql "parseIndexOrderCollation" sql with
+  | Ok f ->
+    let index0 = f.indexes.Head
+    Assert.Equal<string list>([ "id DESC"; "name COLLATE NOCASE ASC" ], index0.columns)
+
+    let expected = [ "CREATE INDEX index0 ON table0(id DESC, name COLLATE NOCASE ASC)" ]
+    Assert.Equal<string list>(expected, Migrate.SqlGeneration.Index.sqlCreateIndex index0)
+  | Error e -> Assert.Fail e
+
+[<Fact>]
+let parseUniqueIndex () =
+  let sql =
+    "CREATE TABLE table0(id integer NOT NULL, name text NOT NULL);
+     CREATE UNIQUE INDEX index0 ON table0(name);"
+
+  match Migrate.SqlParser.parseSql "parseUniqueIndex" sql with
+  | Ok f ->
+    let index0 = f.indexes.Head
+    Assert.True index0.unique
+
+    let expected = [ "CREATE UNIQUE INDEX index0 ON table0(name)" ]
+    Assert.Equal<string list>(expected, Migrate.SqlGeneration.Index.sqlCreateIndex index0)
+  | Error e -> Assert.Fail e
+
+[<Fact>]
+let parseReindentedView () =
+  let table = "CREATE TABLE table0(id integer NOT NULL, name text NOT NULL);"
+  let view0 = table + "CREATE VIEW view0 AS SELECT id, name FROM table0 WHERE id > 0;"
+
+  let view1 =
+    table
+    + "CREATE VIEW view0 AS
+         -- only positive ids
+         SELECT id,
+                name
+         FROM   table0
+         WHERE  id > 0;"
+
+  match Migrate.SqlParser.parseSql "view0" view0, Migrate.SqlParser.parseSql "view1" view1 with
+  | Ok f0, Ok f1 ->
+    Assert.Equal<CreateView list>(f0.views, f1.views)
+
+    let p =
+      { dbFile = ""
+        source = f1
+        syncs = []
+        reports = []
+        pullScript = None
+        schemaVersion = "0.0.0"
+        versionRemarks = "" }
+
+    Assert.Equal(None, Migrate.Calculation.Migration.migration f0 p)
+  | Error e, _
+  | _, Error e -> Assert.Fail e
+
+[<Fact>]
+let parseViewColumns () =
+  let sql =
+    "CREATE TABLE table0(id integer NOT NULL, name text NOT NULL);
+     CREATE VIEW view0(key, label) AS SELECT id, name FROM table0;"
+
+  match Migrate.SqlParser.parseSql "parseViewColumns" sql with
+  | Ok f ->
+    let view0 = f.views.Head
+    Assert.Equal<string list>([ "key"; "label" ], view0.columns)
+
+    let expected = [ "CREATE VIEW view0(\"key\", label) AS\nSELECT id, name FROM table0" ]
+    Assert.Equal<string list>(expected, Migrate.SqlGeneration.View.sqlCreateView view0)
+  | Error e -> Assert.Fail e
+
+[<Fact>]
+let parseTemporaryView () =
+  let sql =
+    "CREATE TABLE table0(id integer NOT NULL);
+     CREATE TEMPORARY VIEW view0 AS SELECT id FROM table0;
+     CREATE TEMP TRIGGER trigger0 AFTER INSERT ON table0 BEGIN SELECT 1; END;"
+
+  match Migrate.SqlParser.parseSql "parseTemporaryView" sql with
+  | Ok f ->
+    Assert.Equal<bool list>([ false ], f.tables |> List.map _.temporary)
+    Assert.Equal<bool list>([ true ], f.triggers |> List.map _.temporary)
+
+    let view0 = f.views.Head
+    Assert.True view0.temporary
+
+    let expected = [ "CREATE TEMP VIEW view0 AS\nSELECT id FROM table0" ]
+    Assert.Equal<string list>(expected, Migrate.SqlGeneration.View.sqlCreateView view0)
+  | Error e -> Assert.Fail e
+
+[<Fact>]
+let parseStatementList () =
+  let sql =
+    "-- schema for the example project
+     PRAGMA foreign_keys = ON;
+
+     CREATE TABLE table0(id integer NOT NULL); -- first table
+     /* a table referencing
+        the first one */
+     CREATE TABLE table1(id integer NOT NULL, t0 integer REFERENCES table0(id));
+     CREATE VIEW view0 AS SELECT id FROM table1;"
+
+  match Migrate.SqlParser.parseSql "parseStatementList" sql with
+  | Ok f ->
+    Assert.Equal<string list>([ "table0"; "table1" ], f.tables |> List.map _.name |> List.sort)
+    Assert.Equal<string list>([ "view0" ], f.views |> List.map _.name)
+  | Error e -> Assert.Fail e
+
+[<Fact>]
+let parseSchemaQualifiedNames () =
+  let sql =
+    "CREATE TABLE main.table0(id integer NOT NULL);
+     CREATE INDEX main.index0 ON table0(id);"
+
+  match Migrate.SqlParser.parseSql "parseSchemaQualifiedNames" sql with
+  | Ok f ->
+    Assert.Equal<string list>([ "table0" ], f.tables |> List.map _.name)
+    Assert.Equal<string list>([ "index0" ], f.indexes |> List.map _.name)
+  | Error e -> Assert.Fail e
+
+  match Migrate.SqlParser.parseSql "parseSchemaQualifiedNames" "CREATE TABLE aux.log(id integer NOT NULL);" with
+  | Ok f -> Assert.Fail $"expecting an error, got {f}"
+  | Error e -> Assert.Contains("aux.log isn't in the main database", e)
+
+[<Fact>]
+let parseVirtualTable () =
+  let sql = "CREATE VIRTUAL TABLE docs USING fts5(title, body);"
+
+  match Migrate.SqlParser.parseSql "parseVirtualTable" sql with
+  | Ok f ->
+    let expected =
+      [ { name = "docs"
+          moduleName = "fts5"
+          moduleArgs = [ "title"; "body" ] } ]
+
+    Assert.Equal<CreateVirtualTable list>(expected, f.virtualTables)
+    Assert.Empty f.tables
+  | Error e -> Assert.Fail e
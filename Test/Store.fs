@@ -41,7 +41,10 @@ let genProposalResult: Gen<ProposalResult> =
     return
       { reason = reason
         statements = statements
-        error = error }
+        error = error
+        rebuilds = None
+        warning = None
+        destructive = false }
   }
 
 let genVersion: Gen<string> =
@@ -71,7 +74,9 @@ let tempDb =
     { tables = []
       indexes = []
       inserts = []
-      views = [] }
+      views = []
+      virtualTables = []
+      triggers = [] }
     "store_insert_test"
 
 let mutable testCount = 0
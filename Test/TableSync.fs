@@ -18,22 +18,20 @@ open Xunit
 
 open Migrate.Types
 open Migrate.Calculation.TableSync
+open Util
 
 let emptySchema =
   { inserts = []
     tables = []
     views = []
-    indexes = [] }
+    indexes = []
+    virtualTables = []
+    triggers = [] }
 
 let colInt name =
-  { name = name
-    columnType = SqlInteger
-    constraints = [ PrimaryKey [] ] }
+  column name SqlInteger [ PrimaryKey [] ]
 
-let colStr name =
-  { name = name
-    columnType = SqlInteger
-    constraints = [ NotNull ] }
+let colStr name = column name SqlInteger [ NotNull ]
 
 let emptyInsert: InsertInto =
   { table = "table0"
@@ -47,9 +45,7 @@ let oneRowInsert: InsertInto =
 let schemaWithOneTable =
   { emptySchema with
       tables =
-        [ { name = "table0"
-            columns = [ colInt "id"; colStr "name" ]
-            constraints = [] } ]
+        [ table "table0" [ colInt "id"; colStr "name" ] [] ]
       inserts = [ oneRowInsert ] }
 
 
@@ -72,7 +68,10 @@ let basicInsert () =
 
   let expected =
     [ { reason = Added "1"
-        statements = [ "INSERT INTO table0(id, name) VALUES (1, 'one')" ] } ]
+        statements = [ "INSERT INTO table0(id, name) VALUES (1, 'one')" ]
+        rebuilds = None
+        warning = None
+        destructive = false } ]
 
   Assert.Equal<SolverProposal list>(expected, xs)
 
@@ -88,7 +87,10 @@ let basicUpdate () =
 
   let expected =
     [ { reason = Changed("zero", "one")
-        statements = [ "UPDATE table0 SET name = 'one' WHERE id = 1" ] } ]
+        statements = [ "UPDATE table0 SET name = 'one' WHERE id = 1" ]
+        rebuilds = None
+        warning = None
+        destructive = false } ]
 
   Assert.Equal<SolverProposal list>(expected, xs)
 
@@ -106,7 +108,10 @@ let basicDelete () =
 
   let expected =
     [ { reason = Removed "1"
-        statements = [ "DELETE FROM table0 WHERE id = 1" ] } ]
+        statements = [ "DELETE FROM table0 WHERE id = 1" ]
+        rebuilds = None
+        warning = None
+        destructive = true } ]
 
   Assert.Equal<SolverProposal list>(expected, xs)
 
@@ -115,9 +120,7 @@ let basicInsertWithKeyInPos2 () =
   let schema =
     { emptySchema with
         tables =
-          [ { name = "table0"
-              columns = [ colInt "id"; colStr "name" ]
-              constraints = [] } ]
+          [ table "table0" [ colInt "id"; colStr "name" ] [] ]
         inserts = [ emptyInsert ] }
 
   let projectSchema =
@@ -136,6 +139,33 @@ let basicInsertWithKeyInPos2 () =
 
   let expected =
     [ { reason = Added "1"
-        statements = [ "INSERT INTO table0(id, name) VALUES (1, 'one')" ] } ]
+        statements = [ "INSERT INTO table0(id, name) VALUES (1, 'one')" ]
+        rebuilds = None
+        warning = None
+        destructive = false } ]
+
+  Assert.Equal<SolverProposal list>(expected, xs)
+
+[<Fact>]
+let insertOnlyNewRows () =
+  let rows =
+    [ [ Integer 1; String "one" ]; [ Integer 2; String "two" ]; [ Integer 3; String "three" ] ]
+
+  let dbSchema =
+    { schemaWithOneTable with
+        inserts = [ { emptyInsert with values = rows |> List.take 2 } ] }
+
+  let project =
+    { emptyProject with
+        source.inserts = [ { emptyInsert with values = rows } ] }
+
+  let xs = insertsMigration dbSchema project
+
+  let expected =
+    [ { reason = Added "3"
+        statements = [ "INSERT INTO table0(id, name) VALUES (3, 'three')" ]
+        rebuilds = None
+        warning = None
+        destructive = false } ]
 
   Assert.Equal<SolverProposal list>(expected, xs)
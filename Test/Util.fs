@@ -16,3 +16,22 @@ module Util
 
 let setenv var value =
   System.Environment.SetEnvironmentVariable(var, value)
+
+open Migrate.Types
+
+let table name columns constraints : CreateTable =
+  { name = name
+    columns = columns
+    constraints = constraints
+    renamedColumns = Map.empty
+    annotations = Map.empty
+    columnComments = Map.empty
+    withoutRowid = false
+    strict = false
+    temporary = false }
+
+let column name columnType constraints : ColumnDef =
+  { name = name
+    columnType = columnType
+    declaredType = None
+    constraints = constraints }